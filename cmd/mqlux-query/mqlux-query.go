@@ -0,0 +1,95 @@
+// mqlux-query prints samples from the database of a mqlux sqlite output as
+// CSV.
+//
+//	mqlux-query -db /var/lib/mqlux/sensors.db -measurement temperature -tag room=kitchen -since 24h
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/sqlite"
+)
+
+// tagFlags collects repeated -tag name=value flags.
+type tagFlags map[string]string
+
+func (t tagFlags) String() string {
+	var tags []string
+	for k, v := range t {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ",")
+}
+
+func (t tagFlags) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected name=value, got %q", s)
+	}
+	t[parts[0]] = parts[1]
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+
+	tags := tagFlags{}
+	db := flag.String("db", "", "path of the SQLite database")
+	measurement := flag.String("measurement", "", "measurement")
+	field := flag.String("field", "", "only print this field")
+	flag.Var(tags, "tag", "only print series with this tag (name=value, can be repeated)")
+	since := flag.Duration("since", 24*time.Hour, "only print samples of this duration (0 for all)")
+	limit := flag.Int("limit", 0, "maximum number of samples (0 for all)")
+	flag.Parse()
+
+	if *db == "" || *measurement == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	q := sqlite.Query{
+		Measurement: *measurement,
+		Field:       *field,
+		Tags:        tags,
+		Limit:       *limit,
+	}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	samples, err := sqlite.Select(*db, q)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"time", "measurement", "tags", "field", "value"})
+	for _, s := range samples {
+		var value string
+		switch v := s.Value.(type) {
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			value = fmt.Sprint(v)
+		}
+		w.Write([]string{
+			s.Time.Format(time.RFC3339Nano),
+			s.Measurement,
+			tagFlags(s.Tags).String(),
+			s.Field,
+			value,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Fatal(err)
+	}
+}
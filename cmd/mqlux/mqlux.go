@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	_ "expvar"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -17,10 +19,10 @@ import (
 	"github.com/comail/colog"
 	"github.com/ktt-ol/mqlux/internal/config"
 	"github.com/ktt-ol/mqlux/internal/debug"
+	"github.com/ktt-ol/mqlux/internal/fieldtype"
 	"github.com/ktt-ol/mqlux/internal/handler/csv"
 	"github.com/ktt-ol/mqlux/internal/handler/keepalive"
 	"github.com/ktt-ol/mqlux/internal/handler/topic"
-	"github.com/ktt-ol/mqlux/internal/influxdb"
 	"github.com/ktt-ol/mqlux/internal/mqlux"
 	"github.com/ktt-ol/mqlux/internal/mqtt"
 	"github.com/ktt-ol/mqlux/internal/parser"
@@ -58,37 +60,16 @@ func main() {
 		log.Fatal(err)
 	}
 
-	var writer mqlux.Writer
-	if config.InfluxDB.URL != "" && *csvFile == "" {
-		db, err := influxdb.NewInfluxDBClient(config)
-		if err != nil {
-			log.Fatal(err)
-		}
-		writer = db.Write
-	} else {
-		writer = func(recs []mqlux.Record) error { return nil }
+	outputs, err := newOutputs(config, *csvFile == "")
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if *isDebug {
-		// wrap original writer with debug logger
-		origWriter := writer
-		writer = func(recs []mqlux.Record) error {
-			var buf bytes.Buffer
-			for _, rec := range recs {
-				buf.Reset()
-				buf.WriteString("measurement ")
-				buf.WriteString(rec.Measurement)
-				fmt.Fprintf(&buf, " -> %v ", rec.Value)
-				for k, v := range rec.Tags {
-					buf.WriteString(k)
-					buf.WriteString("='")
-					buf.WriteString(v)
-					buf.WriteString("' ")
-				}
-				log.Println(buf.String())
-			}
-			return origWriter(recs)
-		}
+	if config.HTTP.Listen != "" {
+		go func() {
+			// serves /debug/vars with internal metrics
+			log.Fatal(http.ListenAndServe(config.HTTP.Listen, nil))
+		}()
 	}
 
 	r := router.New()
@@ -110,7 +91,7 @@ func main() {
 			log.Fatal(err)
 		}
 		defer logger.Stop()
-		r.Add("/#", logger)
+		r.Add("#", logger)
 	}
 
 	if config.MQTT.KeepAlive != "" && *csvFile == "" {
@@ -120,9 +101,10 @@ func main() {
 		}
 		watchdog := keepalive.NewWatchdogHandler(keepAlive)
 		defer watchdog.Stop()
-		r.Add("/#", watchdog)
+		r.Add("#", watchdog)
 	}
 
+	var topics []string
 	for _, sub := range config.Subscriptions {
 		var p mqlux.Parser
 		if sub.Script != "" {
@@ -135,6 +117,14 @@ func main() {
 			p = parser.FloatParser
 		}
 
+		writer, err := outputs.writer(sub.Outputs)
+		if err != nil {
+			log.Fatalf("subscription %s: %s", sub.Topic, err)
+		}
+		if *isDebug {
+			writer = debugWriter(writer)
+		}
+
 		handler, err := topic.New(
 			sub.Topic,
 			sub.Measurement,
@@ -142,12 +132,23 @@ func main() {
 			p,
 			writer,
 		)
-		handler.IncludeRetained(sub.IncludeRetained)
-
 		if err != nil {
 			log.Fatal(err)
 		}
-		r.Add(handler.Topic(), handler)
+		handler.IncludeRetained(sub.IncludeRetained)
+		handler.ValueField(sub.Field)
+		handler.Target(sub.Database, sub.RetentionPolicy)
+		if _, err := fieldtype.ParsePolicy(sub.FieldTypes); err != nil {
+			log.Fatalf("subscription %s: %s", sub.Topic, err)
+		}
+		handler.FieldTypes(sub.FieldTypes)
+		if err := outputs.checkLoop(handler.Topic(), sub.Outputs); err != nil {
+			log.Fatalf("subscription %s: %s", sub.Topic, err)
+		}
+		if err := r.Add(handler.Topic(), handler); err != nil {
+			log.Fatal(err)
+		}
+		topics = append(topics, handler.Topic())
 	}
 
 	if *csvFile != "" {
@@ -159,8 +160,9 @@ func main() {
 	}
 
 	log.Printf("debug: connecting to subscribe")
-	_, err = mqtt.Subscribe(config.MQTT, r.Receive)
-	if err != nil {
+	var conn mqtt.Conn
+	outputs.connect(&conn)
+	if err := conn.Subscribe(config.MQTT, topics, r.Receive); err != nil {
 		log.Fatal(err)
 	}
 
@@ -168,4 +170,34 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	s := <-sigs
 	log.Print("debug: exiting: ", s)
+
+	conn.Unsubscribe()
+	// write all pending records, MQTT outputs still need the connection
+	outputs.Stop()
+	conn.Disconnect(250)
+}
+
+// debugWriter wraps writer and logs all records.
+func debugWriter(writer mqlux.Writer) mqlux.Writer {
+	return func(recs []mqlux.Record) error {
+		var buf bytes.Buffer
+		for _, rec := range recs {
+			buf.Reset()
+			buf.WriteString("measurement ")
+			buf.WriteString(rec.Measurement)
+			buf.WriteString(" ->")
+			for k, v := range rec.FieldValues() {
+				fmt.Fprintf(&buf, " %s=%v", k, v)
+			}
+			buf.WriteString(" ")
+			for k, v := range rec.Tags {
+				buf.WriteString(k)
+				buf.WriteString("='")
+				buf.WriteString(v)
+				buf.WriteString("' ")
+			}
+			log.Println(buf.String())
+		}
+		return writer(recs)
+	}
 }
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/batch"
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/file"
+	"github.com/ktt-ol/mqlux/internal/graphite"
+	"github.com/ktt-ol/mqlux/internal/influxdb"
+	"github.com/ktt-ol/mqlux/internal/loki"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/mqtt"
+	"github.com/ktt-ol/mqlux/internal/opentsdb"
+	"github.com/ktt-ol/mqlux/internal/postgres"
+	"github.com/ktt-ol/mqlux/internal/prometheus"
+	"github.com/ktt-ol/mqlux/internal/socket"
+	"github.com/ktt-ol/mqlux/internal/spool"
+	"github.com/ktt-ol/mqlux/internal/sqlite"
+	"github.com/ktt-ol/mqlux/internal/webhook"
+)
+
+// outputs contains the writers of all configured outputs by name.
+type outputs struct {
+	names   []string
+	writers map[string]mqlux.Writer
+	stop    []func()
+	// subscriptions are used to provision the databases of InfluxDB outputs
+	subscriptions []config.Subscription
+	// republishers need the MQTT connection
+	republishers map[string]*mqtt.Republisher
+}
+
+// newOutputs creates all outputs from the [[output]] sections. The global
+// [influxdb], [prometheus] and [remote_write] sections are added as outputs
+// with the same name. Only the names are registered if start is false (e.g.
+// when reading messages from CSV).
+func newOutputs(conf config.Config, start bool) (*outputs, error) {
+	var outs []config.Output
+	if conf.InfluxDB.URL != "" {
+		outs = append(outs, config.Output{Name: "influxdb", InfluxDB: &conf.InfluxDB})
+	}
+	if conf.Prometheus.Listen != "" {
+		outs = append(outs, config.Output{Name: "prometheus", Prometheus: &conf.Prometheus})
+	}
+	if conf.RemoteWrite.URL != "" {
+		outs = append(outs, config.Output{Name: "remote_write", RemoteWrite: &conf.RemoteWrite})
+	}
+	outs = append(outs, conf.Outputs...)
+
+	o := &outputs{
+		writers:       make(map[string]mqlux.Writer),
+		subscriptions: conf.Subscriptions,
+		republishers:  make(map[string]*mqtt.Republisher),
+	}
+	// spoolDirs contains the output name of each spool_dir, a spool can not be
+	// shared
+	spoolDirs := make(map[string]string)
+	for _, out := range outs {
+		if out.Name == "" {
+			o.Stop()
+			return nil, fmt.Errorf("output without name")
+		}
+		if _, ok := o.writers[out.Name]; ok {
+			o.Stop()
+			return nil, fmt.Errorf("duplicate output %s", out.Name)
+		}
+		if out.InfluxDB != nil && out.InfluxDB.SpoolDir != "" {
+			dir := filepath.Clean(out.InfluxDB.SpoolDir)
+			if other, ok := spoolDirs[dir]; ok {
+				o.Stop()
+				return nil, fmt.Errorf("output %s: spool_dir %s is already used by output %s", out.Name, dir, other)
+			}
+			spoolDirs[dir] = out.Name
+		}
+		var writer mqlux.Writer
+		var err error
+		if start {
+			writer, err = o.start(out)
+		} else {
+			writer, err = validateOutput(out)
+		}
+		if err != nil {
+			o.Stop()
+			return nil, fmt.Errorf("output %s: %s", out.Name, err)
+		}
+		o.names = append(o.names, out.Name)
+		o.writers[out.Name] = writer
+	}
+	return o, nil
+}
+
+// validateOutput checks that out has exactly one backend. It returns a
+// writer that discards all records.
+func validateOutput(out config.Output) (mqlux.Writer, error) {
+	n := 0
+	for _, backend := range []bool{
+		out.InfluxDB != nil,
+		out.Prometheus != nil,
+		out.RemoteWrite != nil,
+		out.UDP != nil,
+		out.TCP != nil,
+		out.MQTT != nil,
+		out.Graphite != nil,
+		out.OpenTSDB != nil,
+		out.Postgres != nil,
+		out.SQLite != nil,
+		out.File != nil,
+		out.Webhook != nil,
+		out.Loki != nil,
+	} {
+		if backend {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("expected exactly one of influxdb, prometheus, remote_write, udp, tcp, mqtt, graphite, opentsdb, postgres, sqlite, file, webhook or loki, got %d", n)
+	}
+	return func(recs []mqlux.Record) error { return nil }, nil
+}
+
+// start creates the writer for the backend of out.
+func (o *outputs) start(out config.Output) (mqlux.Writer, error) {
+	if _, err := validateOutput(out); err != nil {
+		return nil, err
+	}
+	switch {
+	case out.InfluxDB != nil:
+		return o.startInfluxDB(*out.InfluxDB, o.influxDBTargets(out.Name))
+	case out.Prometheus != nil:
+		return o.startPrometheus(*out.Prometheus)
+	case out.RemoteWrite != nil:
+		return o.startRemoteWrite(*out.RemoteWrite)
+	case out.UDP != nil:
+		w, err := socket.NewUDP(*out.UDP)
+		if err != nil {
+			return nil, err
+		}
+		o.stop = append(o.stop, w.Stop)
+		return o.batch(w.Write, out.UDP.BatchSize, out.UDP.FlushInterval)
+	case out.TCP != nil:
+		w, err := socket.NewTCP(*out.TCP)
+		if err != nil {
+			return nil, err
+		}
+		o.stop = append(o.stop, w.Stop)
+		return o.batch(w.Write, out.TCP.BatchSize, out.TCP.FlushInterval)
+	case out.MQTT != nil:
+		r, err := mqtt.NewRepublisher(*out.MQTT)
+		if err != nil {
+			return nil, err
+		}
+		o.republishers[out.Name] = r
+		return o.batch(r.Write, out.MQTT.BatchSize, out.MQTT.FlushInterval)
+	case out.Graphite != nil:
+		w, err := graphite.New(*out.Graphite)
+		if err != nil {
+			return nil, err
+		}
+		o.stop = append(o.stop, w.Stop)
+		return o.batch(w.Write, out.Graphite.BatchSize, out.Graphite.FlushInterval)
+	case out.OpenTSDB != nil:
+		w, err := opentsdb.New(*out.OpenTSDB)
+		if err != nil {
+			return nil, err
+		}
+		o.stop = append(o.stop, w.Stop)
+		return o.batch(w.Write, out.OpenTSDB.BatchSize, out.OpenTSDB.FlushInterval)
+	case out.Postgres != nil:
+		w, err := postgres.New(*out.Postgres)
+		if err != nil {
+			return nil, err
+		}
+		o.stop = append(o.stop, w.Stop)
+		return o.batch(w.Write, out.Postgres.BatchSize, out.Postgres.FlushInterval)
+	case out.SQLite != nil:
+		w, err := sqlite.New(*out.SQLite)
+		if err != nil {
+			return nil, err
+		}
+		o.stop = append(o.stop, w.Stop)
+		return o.batch(w.Write, out.SQLite.BatchSize, out.SQLite.FlushInterval)
+	case out.File != nil:
+		w, err := file.New(*out.File)
+		if err != nil {
+			return nil, err
+		}
+		o.stop = append(o.stop, w.Stop)
+		return o.batch(w.Write, out.File.BatchSize, out.File.FlushInterval)
+	case out.Webhook != nil:
+		w, err := webhook.New(*out.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		return o.batch(w.Write, out.Webhook.BatchSize, out.Webhook.FlushInterval)
+	default:
+		w, err := loki.New(*out.Loki)
+		if err != nil {
+			return nil, err
+		}
+		return o.batch(w.Write, out.Loki.BatchSize, out.Loki.FlushInterval)
+	}
+}
+
+// connect sets the MQTT connection of all MQTT outputs.
+func (o *outputs) connect(p mqtt.Publisher) {
+	for _, r := range o.republishers {
+		r.Connect(p)
+	}
+}
+
+// checkLoop returns an error if one of the named outputs (all outputs if
+// empty) republishes the records of a subscription with filter to a topic
+// that matches the filter, as each republished message would be received
+// again.
+func (o *outputs) checkLoop(filter string, names []string) error {
+	if len(names) == 0 {
+		names = o.names
+	}
+	for _, name := range names {
+		if r, ok := o.republishers[name]; ok && r.Matches(filter) {
+			return fmt.Errorf("output %s republishes to topics that match %s", name, filter)
+		}
+	}
+	return nil
+}
+
+// influxDBTargets returns the databases and retention policies of all
+// subscriptions that write to the named output.
+func (o *outputs) influxDBTargets(name string) []influxdb.Target {
+	var targets []influxdb.Target
+	for _, sub := range o.subscriptions {
+		if sub.Database == "" && sub.RetentionPolicy == "" {
+			continue
+		}
+		if len(sub.Outputs) > 0 && !contains(sub.Outputs, name) {
+			continue
+		}
+		targets = append(targets, influxdb.Target{Database: sub.Database, RetentionPolicy: sub.RetentionPolicy})
+	}
+	return targets
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *outputs) startInfluxDB(conf config.InfluxDB, targets []influxdb.Target) (mqlux.Writer, error) {
+	db, err := influxdb.NewInfluxDBClient(conf, targets...)
+	if err != nil {
+		return nil, err
+	}
+	if conf.SeedFieldTypes {
+		if err := db.SeedFieldTypes(); err != nil {
+			log.Printf("warning: loading field types from %s", err)
+		}
+	}
+	var writer mqlux.Writer = db.Write
+	if conf.SpoolDir != "" {
+		retention, err := parseDuration(conf.SpoolRetention, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool_retention duration: %s", err)
+		}
+		s, err := spool.New(conf.SpoolDir, conf.SpoolMaxSize<<20, retention, writer)
+		if err != nil {
+			return nil, err
+		}
+		o.stop = append(o.stop, s.Stop)
+		writer = s.Write
+	}
+	return o.batch(writer, conf.BatchSize, conf.FlushInterval)
+}
+
+func (o *outputs) startPrometheus(conf config.Prometheus) (mqlux.Writer, error) {
+	expiry, err := parseDuration(conf.Expiry, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry duration: %s", err)
+	}
+	exporter := prometheus.New(conf.Prefix, expiry)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	go func() {
+		log.Fatal(http.ListenAndServe(conf.Listen, mux))
+	}()
+	return exporter.Write, nil
+}
+
+func (o *outputs) startRemoteWrite(conf config.RemoteWrite) (mqlux.Writer, error) {
+	rw, err := prometheus.NewRemoteWriter(conf)
+	if err != nil {
+		return nil, err
+	}
+	return o.batch(rw.Write, conf.BatchSize, conf.FlushInterval)
+}
+
+// batch wraps writer with a batch.Writer. size defaults to 1000 records and
+// interval to one second.
+func (o *outputs) batch(writer mqlux.Writer, size int, interval string) (mqlux.Writer, error) {
+	if size == 0 {
+		size = 1000
+	}
+	flushInterval, err := parseDuration(interval, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flush_interval duration: %s", err)
+	}
+	w := batch.New(writer, size, flushInterval)
+	// batch writers need to stop before the underlying writers (e.g. spool)
+	o.stop = append(o.stop, w.Stop)
+	return w.Write, nil
+}
+
+// writer returns a writer for the named outputs, or for all outputs if names
+// is empty.
+func (o *outputs) writer(names []string) (mqlux.Writer, error) {
+	if len(names) == 0 {
+		names = o.names
+	}
+	writers := make([]mqlux.Writer, 0, len(names))
+	for _, name := range names {
+		w, ok := o.writers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown output %s", name)
+		}
+		writers = append(writers, w)
+	}
+	return multiWriter(writers), nil
+}
+
+// Stop writes all pending records and stops all outputs.
+func (o *outputs) Stop() {
+	for i := len(o.stop) - 1; i >= 0; i-- {
+		o.stop[i]()
+	}
+}
+
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// multiWriter returns a writer that writes all records to each writer.
+func multiWriter(writers []mqlux.Writer) mqlux.Writer {
+	return func(recs []mqlux.Record) error {
+		var firstErr error
+		for _, w := range writers {
+			if err := w(recs); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+}
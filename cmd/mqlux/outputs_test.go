@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/influxdb"
+)
+
+func TestOutputs(t *testing.T) {
+	conf := config.Config{}
+	conf.InfluxDB.URL = "http://localhost:8086"
+	conf.Outputs = []config.Output{
+		{Name: "longterm", InfluxDB: &config.InfluxDB{URL: "http://localhost:8086", Database: "longterm"}},
+		{Name: "realtime", RemoteWrite: &config.RemoteWrite{URL: "http://localhost:8428/api/v1/write"}},
+		{Name: "telegraf", UDP: &config.Socket{Address: "localhost:8094"}},
+		{Name: "normalized", MQTT: &config.Republish{Topic: "normalized/{measurement}"}},
+		{Name: "graphite", Graphite: &config.Graphite{Address: "localhost:2003"}},
+		{Name: "events", Loki: &config.Loki{URL: "http://localhost:3100"}},
+	}
+	o, err := newOutputs(conf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"influxdb", "longterm", "realtime", "telegraf", "normalized", "graphite", "events"}; !reflect.DeepEqual(o.names, want) {
+		t.Errorf("unexpected outputs %v != %v", o.names, want)
+	}
+	if _, err := o.writer(nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := o.writer([]string{"longterm", "realtime"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := o.writer([]string{"debug"}); err == nil {
+		t.Error("expected error for unknown output")
+	}
+}
+
+func TestInvalidOutputs(t *testing.T) {
+	for _, outs := range [][]config.Output{
+		{{InfluxDB: &config.InfluxDB{}}},
+		{{Name: "a", InfluxDB: &config.InfluxDB{}}, {Name: "a", InfluxDB: &config.InfluxDB{}}},
+		{{Name: "a"}},
+		{{Name: "a", InfluxDB: &config.InfluxDB{}, Prometheus: &config.Prometheus{}}},
+		{{Name: "a", UDP: &config.Socket{}, TCP: &config.Socket{}}},
+		{{Name: "a", MQTT: &config.Republish{}, TCP: &config.Socket{}}},
+		{{Name: "a", Graphite: &config.Graphite{}, OpenTSDB: &config.OpenTSDB{}}},
+		{{Name: "a", Webhook: &config.Webhook{}, Loki: &config.Loki{}}},
+		{
+			{Name: "a", InfluxDB: &config.InfluxDB{SpoolDir: "/var/lib/mqlux/spool"}},
+			{Name: "b", InfluxDB: &config.InfluxDB{SpoolDir: "/var/lib/mqlux/spool/"}},
+		},
+	} {
+		if _, err := newOutputs(config.Config{Outputs: outs}, false); err == nil {
+			t.Errorf("expected error for %v", outs)
+		}
+	}
+}
+
+func TestRepublishLoop(t *testing.T) {
+	conf := config.Config{}
+	conf.Outputs = []config.Output{
+		{Name: "normalized", MQTT: &config.Republish{Topic: "normalized/{measurement}"}},
+		{Name: "archive", File: &config.File{Path: filepath.Join(os.TempDir(), "mqlux-loop", "records.lp")}},
+	}
+	o, err := newOutputs(conf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Stop()
+	defer os.RemoveAll(filepath.Join(os.TempDir(), "mqlux-loop"))
+
+	if err := o.checkLoop("sensors/#", nil); err != nil {
+		t.Error(err)
+	}
+	if err := o.checkLoop("#", nil); err == nil {
+		t.Error("expected error for loop")
+	}
+	if err := o.checkLoop("#", []string{"archive"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInfluxDBTargets(t *testing.T) {
+	o := &outputs{subscriptions: []config.Subscription{
+		{Topic: "sensors/#"},
+		{Topic: "events/#", Database: "events"},
+		{Topic: "energy/#", RetentionPolicy: "one_year", Outputs: []string{"influxdb"}},
+		{Topic: "archive/#", Database: "archive", Outputs: []string{"longterm"}},
+	}}
+	want := []influxdb.Target{{Database: "events"}, {RetentionPolicy: "one_year"}}
+	if actual := o.influxDBTargets("influxdb"); !reflect.DeepEqual(actual, want) {
+		t.Errorf("unexpected targets %v != %v", actual, want)
+	}
+	want = []influxdb.Target{{Database: "events"}, {Database: "archive"}}
+	if actual := o.influxDBTargets("longterm"); !reflect.DeepEqual(actual, want) {
+		t.Errorf("unexpected targets %v != %v", actual, want)
+	}
+}
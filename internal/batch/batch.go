@@ -0,0 +1,147 @@
+package batch
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+// stats exports the number of blocked writes as batch in /debug/vars.
+var stats = expvar.NewMap("batch")
+
+// maxPendingBatches limits the number of records that are kept if the
+// underlying writer is slower than the incoming records.
+const maxPendingBatches = 10
+
+var errStopped = errors.New("batch writer is stopped")
+
+// Writer collects records from multiple producers and forwards them in
+// batches to another writer. A batch is written as soon as it contains size
+// records, or after interval.
+type Writer struct {
+	writer   mqlux.Writer
+	size     int
+	interval time.Duration
+
+	mu      sync.Mutex
+	records []mqlux.Record
+	// space is signaled when pending records were taken for writing
+	space  *sync.Cond
+	closed bool
+
+	flush   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// New starts a new batch Writer that forwards all records to writer.
+func New(writer mqlux.Writer, size int, interval time.Duration) *Writer {
+	if size < 1 {
+		size = 1
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	w := &Writer{
+		writer:   writer,
+		size:     size,
+		interval: interval,
+		records:  make([]mqlux.Record, 0, size),
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	w.space = sync.NewCond(&w.mu)
+	go w.run()
+	return w
+}
+
+// Write adds the records to the current batch. It does not block while the
+// batch is written, unless the underlying writer is too slow and
+// maxPendingBatches are already pending. Write blocks until the pending
+// records are taken for writing in this case.
+func (w *Writer) Write(recs []mqlux.Record) error {
+	w.mu.Lock()
+	if w.full(len(recs)) {
+		stats.Add("writes_blocked", 1)
+		for w.full(len(recs)) {
+			w.space.Wait()
+		}
+	}
+	if w.closed {
+		w.mu.Unlock()
+		return errStopped
+	}
+	w.records = append(w.records, recs...)
+	full := len(w.records) >= w.size
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+			// flush is already pending
+		}
+	}
+	return nil
+}
+
+// full checks whether n more records exceed the pending records limit. A
+// larger number of records is accepted if nothing is pending.
+func (w *Writer) full(n int) bool {
+	return !w.closed && len(w.records) > 0 && len(w.records)+n > w.size*maxPendingBatches
+}
+
+// Stop writes all pending records and stops the Writer. Later writes (and
+// writes that are blocked) return an error.
+func (w *Writer) Stop() {
+	// closed is set before the final write, so that no records are added
+	// after it
+	w.mu.Lock()
+	w.closed = true
+	w.space.Broadcast()
+	w.mu.Unlock()
+	close(w.done)
+	<-w.stopped
+}
+
+func (w *Writer) run() {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.write()
+		case <-w.flush:
+			w.write()
+		case <-w.done:
+			w.write()
+			close(w.stopped)
+			return
+		}
+	}
+}
+
+// write writes all pending records in batches of size.
+func (w *Writer) write() {
+	w.mu.Lock()
+	recs := w.records
+	w.records = make([]mqlux.Record, 0, w.size)
+	w.space.Broadcast()
+	w.mu.Unlock()
+
+	for len(recs) > 0 {
+		n := w.size
+		if n > len(recs) {
+			n = len(recs)
+		}
+		if err := w.writer(recs[:n]); err != nil {
+			log.Println("error: writing records", err)
+		}
+		recs = recs[n:]
+	}
+}
@@ -0,0 +1,195 @@
+package batch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]mqlux.Record
+	written chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{written: make(chan struct{}, 100)}
+}
+
+func (r *recorder) Write(recs []mqlux.Record) error {
+	r.mu.Lock()
+	batch := make([]mqlux.Record, len(recs))
+	copy(batch, recs)
+	r.batches = append(r.batches, batch)
+	r.mu.Unlock()
+	r.written <- struct{}{}
+	return nil
+}
+
+func (r *recorder) sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sizes []int
+	for _, b := range r.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func records(n int) []mqlux.Record {
+	recs := make([]mqlux.Record, n)
+	for i := range recs {
+		recs[i] = mqlux.Record{Measurement: "test", Value: float64(i)}
+	}
+	return recs
+}
+
+func TestFlushBySize(t *testing.T) {
+	r := newRecorder()
+	w := New(r.Write, 10, time.Hour)
+	for i := 0; i < 5; i++ {
+		w.Write(records(2))
+	}
+	select {
+	case <-r.written:
+	case <-time.After(time.Second):
+		t.Fatal("batch was not written")
+	}
+	w.Stop()
+	if sizes := r.sizes(); len(sizes) != 1 || sizes[0] != 10 {
+		t.Errorf("unexpected batches %v", sizes)
+	}
+}
+
+func TestFlushByInterval(t *testing.T) {
+	r := newRecorder()
+	w := New(r.Write, 10, 10*time.Millisecond)
+	defer w.Stop()
+	w.Write(records(3))
+	select {
+	case <-r.written:
+	case <-time.After(time.Second):
+		t.Fatal("batch was not written")
+	}
+	if sizes := r.sizes(); len(sizes) != 1 || sizes[0] != 3 {
+		t.Errorf("unexpected batches %v", sizes)
+	}
+}
+
+func TestFlushOnStop(t *testing.T) {
+	r := newRecorder()
+	w := New(r.Write, 10, time.Hour)
+	w.Write(records(25))
+	w.Write(records(1))
+	w.Stop()
+	total := 0
+	for _, size := range r.sizes() {
+		if size > 10 {
+			t.Errorf("batch larger than size: %d", size)
+		}
+		total += size
+	}
+	if total != 26 {
+		t.Errorf("expected 26 records, got %d", total)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	written := 0
+	w := New(func(recs []mqlux.Record) error {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+		mu.Lock()
+		written += len(recs)
+		mu.Unlock()
+		return nil
+	}, 1, time.Hour)
+
+	w.Write(records(1))
+	<-entered
+	// the writer is blocked, maxPendingBatches records are pending
+	blocked := make(chan struct{})
+	go func() {
+		for i := 0; i < maxPendingBatches+1; i++ {
+			w.Write(records(1))
+		}
+		close(blocked)
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("Write did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("Write is still blocked")
+	}
+	w.Stop()
+	if written != maxPendingBatches+2 {
+		t.Errorf("expected %d records, got %d", maxPendingBatches+2, written)
+	}
+	if err := w.Write(records(1)); err == nil {
+		t.Error("expected error after Stop")
+	}
+}
+
+func TestStopBlocked(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	written := 0
+	w := New(func(recs []mqlux.Record) error {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+		mu.Lock()
+		written += len(recs)
+		mu.Unlock()
+		return nil
+	}, 1, time.Hour)
+
+	w.Write(records(1))
+	<-entered
+	for i := 0; i < maxPendingBatches; i++ {
+		w.Write(records(1))
+	}
+	blocked := make(chan error)
+	go func() {
+		blocked <- w.Write(records(1))
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	select {
+	case err := <-blocked:
+		if err != errStopped {
+			t.Errorf("expected errStopped for blocked Write, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write is still blocked after Stop")
+	}
+	if err := w.Write(records(1)); err != errStopped {
+		t.Errorf("expected errStopped while stopping, got %v", err)
+	}
+
+	close(release)
+	<-stopped
+	if written != maxPendingBatches+1 {
+		t.Errorf("expected %d records, got %d", maxPendingBatches+1, written)
+	}
+}
@@ -3,6 +3,10 @@ package config
 type Config struct {
 	MQTT          MQTT
 	InfluxDB      InfluxDB
+	Prometheus    Prometheus
+	RemoteWrite   RemoteWrite `toml:"remote_write"`
+	Outputs       []Output    `toml:"output"`
+	HTTP          HTTP
 	Subscriptions []Subscription `toml:"subscription"`
 	CACertFiles   []string
 }
@@ -19,17 +23,177 @@ type MQTT struct {
 }
 
 type InfluxDB struct {
-	URL             string
-	Username        string
-	Password        string
-	Database        string
-	RetentionPolicy string `toml:"retention_policy"`
+	URL                  string
+	Username             string
+	Password             string
+	Database             string
+	RetentionPolicy      string `toml:"retention_policy"`
+	CreateDatabase       bool   `toml:"create_database"`
+	RetentionDuration    string `toml:"retention_duration"`
+	RetentionReplication int    `toml:"retention_replication"`
+	RetentionDefault     bool   `toml:"retention_default"`
+	SeedFieldTypes       bool   `toml:"seed_field_types"`
+	Precision            string
+	BatchSize            int    `toml:"batch_size"`
+	FlushInterval        string `toml:"flush_interval"`
+	SpoolDir             string `toml:"spool_dir"`
+	SpoolMaxSize         int64  `toml:"spool_max_size"`
+	SpoolRetention       string `toml:"spool_retention"`
+	Retries              int
+	DeadLetterFile       string `toml:"dead_letter_file"`
+	Org                  string
+	Bucket               string
+	Token                string
+	Gzip                 bool
+}
+
+type Prometheus struct {
+	Listen string
+	Prefix string
+	Expiry string
+}
+
+type RemoteWrite struct {
+	URL           string
+	Username      string
+	Password      string
+	BearerToken   string `toml:"bearer_token"`
+	Prefix        string
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval string `toml:"flush_interval"`
+	Retries       int
+}
+
+// Output is a named output with exactly one backend.
+type Output struct {
+	Name        string
+	InfluxDB    *InfluxDB
+	Prometheus  *Prometheus
+	RemoteWrite *RemoteWrite `toml:"remote_write"`
+	UDP         *Socket      `toml:"udp"`
+	TCP         *Socket      `toml:"tcp"`
+	MQTT        *Republish   `toml:"mqtt"`
+	Graphite    *Graphite    `toml:"graphite"`
+	OpenTSDB    *OpenTSDB    `toml:"opentsdb"`
+	Postgres    *Postgres    `toml:"postgres"`
+	SQLite      *SQLite      `toml:"sqlite"`
+	File        *File        `toml:"file"`
+	Webhook     *Webhook     `toml:"webhook"`
+	Loki        *Loki        `toml:"loki"`
+}
+
+// Loki pushes string fields to Grafana Loki.
+type Loki struct {
+	URL           string
+	Username      string
+	Password      string
+	TenantID      string `toml:"tenant_id"`
+	Labels        map[string]string
+	Retries       int
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval string `toml:"flush_interval"`
+}
+
+// Webhook sends records to an HTTP endpoint.
+type Webhook struct {
+	URL               string
+	Method            string
+	Headers           map[string]string
+	ContentType       string `toml:"content_type"`
+	Template          string
+	Mode              string
+	Timeout           string
+	Retries           int
+	TLSServerCert     string `toml:"tls_server_cert"`
+	TLSServerInsecure bool   `toml:"tls_server_insecure"`
+	TLSClientCert     string `toml:"tls_client_cert"`
+	TLSClientKey      string `toml:"tls_client_key"`
+	BatchSize         int    `toml:"batch_size"`
+	FlushInterval     string `toml:"flush_interval"`
+}
+
+// File archives records in rotated files.
+type File struct {
+	Path           string
+	Format         string
+	Precision      string
+	MaxSize        int64  `toml:"max_size"`
+	RotateInterval string `toml:"rotate_interval"`
+	Gzip           bool
+	BatchSize      int    `toml:"batch_size"`
+	FlushInterval  string `toml:"flush_interval"`
+}
+
+// SQLite stores records in a local SQLite database.
+type SQLite struct {
+	Path          string
+	Retention     string
+	PruneInterval string `toml:"prune_interval"`
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval string `toml:"flush_interval"`
+}
+
+// Postgres writes records to a PostgreSQL or TimescaleDB table.
+type Postgres struct {
+	URL           string
+	Table         string
+	TagColumns    []string `toml:"tag_columns"`
+	Hypertable    bool
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval string `toml:"flush_interval"`
+}
+
+// Graphite sends records in the Graphite plaintext protocol.
+type Graphite struct {
+	Address       string
+	Prefix        string
+	Tagged        bool
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval string `toml:"flush_interval"`
+}
+
+// OpenTSDB sends records with the telnet put command (Address) or the
+// HTTP API (URL).
+type OpenTSDB struct {
+	Address       string
+	URL           string
+	Prefix        string
+	Retries       int
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval string `toml:"flush_interval"`
+}
+
+// Republish publishes records back to the MQTT server.
+type Republish struct {
+	Topic         string
+	Format        string
+	QoS           byte `toml:"qos"`
+	Retain        bool
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval string `toml:"flush_interval"`
+}
+
+type Socket struct {
+	Address       string
+	Precision     string
+	MaxPacketSize int    `toml:"max_packet_size"`
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval string `toml:"flush_interval"`
+}
+
+type HTTP struct {
+	Listen string
 }
 
 type Subscription struct {
 	Topic           string
 	Measurement     string
+	Field           string
 	Tags            map[string]string
 	Script          string
 	IncludeRetained bool `toml:"include_retained"`
+	Outputs         []string
+	Database        string
+	RetentionPolicy string `toml:"retention_policy"`
+	FieldTypes      string `toml:"field_types"`
 }
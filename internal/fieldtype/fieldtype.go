@@ -0,0 +1,274 @@
+// Package fieldtype protects InfluxDB writes against field type conflicts.
+//
+// InfluxDB rejects points with a field value of another type than the
+// values that were written before (e.g. a string "unavailable" into a float
+// field). The Tracker remembers the type of each field per database and
+// measurement and coerces or rejects conflicting values before they are
+// written. Types are only known from SHOW FIELD KEYS (Seed) or from points
+// that were accepted by InfluxDB (Learn), so that a single invalid value does
+// not block all later values of its field.
+package fieldtype
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+// stats exports the number of coerced and rejected values as field_types in
+// /debug/vars.
+var stats = expvar.NewMap("field_types")
+
+// Type is a field type as named by InfluxDB.
+type Type string
+
+const (
+	Float   Type = "float"
+	Integer Type = "integer"
+	String  Type = "string"
+	Boolean Type = "boolean"
+)
+
+// ParseType returns the Type for the field types of SHOW FIELD KEYS.
+func ParseType(s string) (Type, error) {
+	switch s {
+	case "float":
+		return Float, nil
+	case "integer", "unsigned":
+		return Integer, nil
+	case "string":
+		return String, nil
+	case "boolean":
+		return Boolean, nil
+	}
+	return "", fmt.Errorf("unknown field type %s", s)
+}
+
+// TypeOf returns the Type of a field value. ok is false for nil and
+// unsupported values.
+func TypeOf(v interface{}) (typ Type, ok bool) {
+	switch v.(type) {
+	case float64, float32:
+		return Float, true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32:
+		return Integer, true
+	case string:
+		return String, true
+	case bool:
+		return Boolean, true
+	}
+	return "", false
+}
+
+// Policy defines how conflicting values are handled.
+type Policy int
+
+const (
+	// Reject drops conflicting fields (and records without other fields).
+	Reject Policy = iota
+	// Coerce converts conflicting values into the known type (e.g. "21.5" to
+	// 21.5) and drops fields that can not be converted.
+	Coerce
+	// Ignore writes all values without checking their types.
+	Ignore
+)
+
+// ParsePolicy parses reject, coerce or ignore (e.g. the FieldTypes of a
+// record). The empty string is Reject.
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "", "reject":
+		return Reject, nil
+	case "coerce":
+		return Coerce, nil
+	case "ignore":
+		return Ignore, nil
+	}
+	return 0, fmt.Errorf("unknown field type policy %s, expected reject, coerce or ignore", s)
+}
+
+type key struct {
+	database, measurement, field string
+}
+
+// Tracker remembers the type of each field per database and measurement.
+type Tracker struct {
+	mu    sync.Mutex
+	types map[key]Type
+}
+
+// New returns an empty Tracker.
+func New() *Tracker {
+	return &Tracker{types: make(map[key]Type)}
+}
+
+// Seed sets the type of a field that already exists (e.g. from SHOW FIELD
+// KEYS). Already known types are not changed.
+func (t *Tracker) Seed(database, measurement, field string, typ Type) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key{database, measurement, field}
+	if _, ok := t.types[k]; ok {
+		return
+	}
+	t.types[k] = typ
+}
+
+// Learn remembers the types of the fields of rec, after rec was written into
+// database. Already known types are not changed.
+func (t *Tracker) Learn(database string, rec mqlux.Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for field, v := range rec.FieldValues() {
+		typ, ok := TypeOf(v)
+		if !ok {
+			continue
+		}
+		k := key{database, rec.Measurement, field}
+		if _, ok := t.types[k]; !ok {
+			t.types[k] = typ
+		}
+	}
+}
+
+// Check checks the field types of rec, which is written into database.
+// Fields without a known type are not checked. Conflicting values are handled according to the FieldTypes policy of rec
+// (Reject if invalid). ok is false if no field of rec is left.
+func (t *Tracker) Check(database string, rec mqlux.Record) (checked mqlux.Record, ok bool) {
+	policy, err := ParsePolicy(rec.FieldTypes)
+	if err != nil {
+		policy = Reject
+	}
+	if policy == Ignore {
+		return rec, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return rec, t.checkRecord(database, &rec, policy)
+}
+
+// checkRecord updates the fields of rec and returns false if no field is left.
+func (t *Tracker) checkRecord(database string, rec *mqlux.Record, policy Policy) bool {
+	fields := rec.FieldValues()
+	var changed map[string]interface{}
+	for field, v := range fields {
+		typ, ok := TypeOf(v)
+		if !ok {
+			continue
+		}
+		known, ok := t.types[key{database, rec.Measurement, field}]
+		if !ok || known == typ {
+			continue
+		}
+
+		if changed == nil {
+			changed = make(map[string]interface{}, len(fields))
+			for f, v := range fields {
+				changed[f] = v
+			}
+		}
+		if policy == Coerce {
+			if cv, ok := coerce(v, known); ok {
+				stats.Add("coerced", 1)
+				log.Printf("debug: coerced field %s of %s from %s %v to %s", field, rec.Measurement, typ, v, known)
+				changed[field] = cv
+				continue
+			}
+		}
+		stats.Add("rejected", 1)
+		log.Printf("warning: rejecting field %s of %s: %s %v conflicts with %s field", field, rec.Measurement, typ, v, known)
+		delete(changed, field)
+	}
+
+	if changed == nil {
+		return true
+	}
+	if len(changed) == 0 {
+		return false
+	}
+	rec.Value = nil
+	rec.Fields = changed
+	return true
+}
+
+// coerce converts v into typ.
+func coerce(v interface{}, typ Type) (interface{}, bool) {
+	switch typ {
+	case Float:
+		switch v := v.(type) {
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			return f, err == nil
+		case bool:
+			if v {
+				return 1.0, true
+			}
+			return 0.0, true
+		}
+		if i, ok := toInt(v); ok {
+			return float64(i), true
+		}
+	case Integer:
+		switch v := v.(type) {
+		case string:
+			i, err := strconv.ParseInt(v, 10, 64)
+			return i, err == nil
+		case bool:
+			if v {
+				return int64(1), true
+			}
+			return int64(0), true
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+				return int64(v), true
+			}
+		case float32:
+			return coerce(float64(v), typ)
+		}
+	case String:
+		return fmt.Sprint(v), true
+	case Boolean:
+		switch v := v.(type) {
+		case string:
+			b, err := strconv.ParseBool(v)
+			return b, err == nil
+		case float64:
+			if v == 0 || v == 1 {
+				return v == 1, true
+			}
+		}
+		if i, ok := toInt(v); ok && (i == 0 || i == 1) {
+			return i == 1, true
+		}
+	}
+	return nil, false
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,174 @@
+package fieldtype
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+func TestCheck(t *testing.T) {
+	for _, test := range []struct {
+		Policy string
+		Seed   map[string]Type
+		Input  []mqlux.Record
+		Want   []mqlux.Record
+	}{
+		{
+			Policy: "reject",
+			Input: []mqlux.Record{
+				{Measurement: "temperature", Value: 21.5},
+				{Measurement: "temperature", Value: "unavailable"},
+				{Measurement: "temperature", Value: 22.0},
+			},
+			Want: []mqlux.Record{
+				{Measurement: "temperature", Value: 21.5},
+				{Measurement: "temperature", Value: 22.0},
+			},
+		},
+		{
+			Policy: "reject",
+			Seed:   map[string]Type{"value": Boolean},
+			Input: []mqlux.Record{
+				{Measurement: "temperature", Value: true},
+				{Measurement: "temperature", Value: 21.5},
+			},
+			Want: []mqlux.Record{
+				{Measurement: "temperature", Value: true},
+			},
+		},
+		{
+			// only the conflicting field is removed
+			Policy: "reject",
+			Seed:   map[string]Type{"humidity": Float, "value": Float},
+			Input: []mqlux.Record{
+				{Measurement: "temperature", Value: 21.5, Fields: map[string]interface{}{"humidity": "n/a"}},
+				{Measurement: "temperature", Value: "n/a", Fields: map[string]interface{}{"humidity": 40.0}},
+			},
+			Want: []mqlux.Record{
+				{Measurement: "temperature", Fields: map[string]interface{}{"value": 21.5}},
+				{Measurement: "temperature", Fields: map[string]interface{}{"humidity": 40.0}},
+			},
+		},
+		{
+			Policy: "coerce",
+			Seed:   map[string]Type{"value": Float, "count": Integer, "state": String, "on": Boolean},
+			Input: []mqlux.Record{
+				{Measurement: "temperature", Value: "21.5"},
+				{Measurement: "temperature", Value: 21},
+				{Measurement: "temperature", Value: true},
+				{Measurement: "temperature", Value: "unavailable"},
+				{Measurement: "temperature", Fields: map[string]interface{}{"count": 42.0, "state": 1.5, "on": "true"}},
+				{Measurement: "temperature", Fields: map[string]interface{}{"count": 42.5, "on": 1.0}},
+			},
+			Want: []mqlux.Record{
+				{Measurement: "temperature", Fields: map[string]interface{}{"value": 21.5}},
+				{Measurement: "temperature", Fields: map[string]interface{}{"value": 21.0}},
+				{Measurement: "temperature", Fields: map[string]interface{}{"value": 1.0}},
+				{Measurement: "temperature", Fields: map[string]interface{}{"count": int64(42), "state": "1.5", "on": true}},
+				{Measurement: "temperature", Fields: map[string]interface{}{"on": true}},
+			},
+		},
+		{
+			Policy: "ignore",
+			Seed:   map[string]Type{"value": Float},
+			Input: []mqlux.Record{
+				{Measurement: "temperature", Value: "unavailable"},
+			},
+			Want: []mqlux.Record{
+				{Measurement: "temperature", Value: "unavailable"},
+			},
+		},
+		{
+			// nil values and other measurements are not checked
+			Policy: "reject",
+			Seed:   map[string]Type{"value": Float},
+			Input: []mqlux.Record{
+				{Measurement: "temperature", Value: nil},
+				{Measurement: "status", Value: "online"},
+			},
+			Want: []mqlux.Record{
+				{Measurement: "temperature", Value: nil},
+				{Measurement: "status", Value: "online"},
+			},
+		},
+	} {
+		tr := New()
+		for field, typ := range test.Seed {
+			tr.Seed("sensors", "temperature", field, typ)
+		}
+		var actual []mqlux.Record
+		for _, rec := range test.Input {
+			rec.FieldTypes = test.Policy
+			if rec, ok := tr.Check("sensors", rec); ok {
+				// the record was written successfully
+				tr.Learn("sensors", rec)
+				rec.FieldTypes = ""
+				actual = append(actual, rec)
+			}
+		}
+		if !reflect.DeepEqual(actual, test.Want) {
+			t.Errorf("unexpected records for %v\n%v\n!=\n%v", test.Seed, actual, test.Want)
+		}
+	}
+}
+
+func TestCheckUnknown(t *testing.T) {
+	tr := New()
+	// a rejected first value is not learned
+	if _, ok := tr.Check("sensors", mqlux.Record{Measurement: "temperature", Value: "unavailable"}); !ok {
+		t.Error("unexpected conflict for unknown field")
+	}
+	if _, ok := tr.Check("sensors", mqlux.Record{Measurement: "temperature", Value: 21.5}); !ok {
+		t.Error("unexpected conflict for unknown field")
+	}
+	tr.Learn("sensors", mqlux.Record{Measurement: "temperature", Value: 21.5})
+	if _, ok := tr.Check("sensors", mqlux.Record{Measurement: "temperature", Value: "unavailable"}); ok {
+		t.Error("expected conflict with learned float field")
+	}
+	// learned types do not replace seeded types
+	tr.Seed("sensors", "status", "value", String)
+	tr.Learn("sensors", mqlux.Record{Measurement: "status", Value: 1.0})
+	if _, ok := tr.Check("sensors", mqlux.Record{Measurement: "status", Value: "online"}); !ok {
+		t.Error("unexpected conflict with seeded string field")
+	}
+}
+
+func TestCheckDatabases(t *testing.T) {
+	tr := New()
+	tr.Seed("sensors", "status", "value", Float)
+	if _, ok := tr.Check("sensors", mqlux.Record{Measurement: "status", Value: "online"}); ok {
+		t.Error("expected conflict in sensors")
+	}
+	// same measurement and field in another database
+	if _, ok := tr.Check("events", mqlux.Record{Measurement: "status", Value: "online"}); !ok {
+		t.Error("unexpected conflict in events")
+	}
+	tr.Learn("events", mqlux.Record{Measurement: "status", Value: "online"})
+	if _, ok := tr.Check("events", mqlux.Record{Measurement: "status", Value: 1.0}); ok {
+		t.Error("expected conflict with tracked string field in events")
+	}
+}
+
+func TestParse(t *testing.T) {
+	for s, want := range map[string]Type{
+		"float":    Float,
+		"integer":  Integer,
+		"unsigned": Integer,
+		"string":   String,
+		"boolean":  Boolean,
+	} {
+		if typ, err := ParseType(s); err != nil || typ != want {
+			t.Errorf("ParseType(%s) = %s, %v", s, typ, err)
+		}
+	}
+	if _, err := ParseType("double"); err == nil {
+		t.Error("expected error for unknown type")
+	}
+	if p, err := ParsePolicy(""); err != nil || p != Reject {
+		t.Errorf("unexpected default policy %v %v", p, err)
+	}
+	if _, err := ParsePolicy("drop"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
@@ -0,0 +1,265 @@
+// Package file archives records in local files, either in the InfluxDB line
+// protocol or as JSON Lines. Files are rotated by size and age and can be
+// gzip compressed.
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/lineprotocol"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+// stats exports the number of written records, rotated files and errors as
+// file in /debug/vars.
+var stats = expvar.NewMap("file")
+
+// timeFormat is the timestamp in the name of each file.
+const timeFormat = "20060102T150405Z"
+
+// Writer writes records to rotated files.
+type Writer struct {
+	base, ext string
+	json      bool
+	precision string
+	gzip      bool
+	maxSize   int64
+	maxAge    time.Duration
+
+	mu      sync.Mutex
+	f       *os.File
+	buf     *bufio.Writer
+	gz      *gzip.Writer
+	w       io.Writer
+	size    int64
+	created time.Time
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// New creates a new Writer. Each file is named after the path of conf with
+// the creation time appended to the base name (e.g. records.lp is written
+// to records-20180201T120000Z.lp). The first file is created with the
+// first write.
+func New(conf config.File) (*Writer, error) {
+	if conf.Path == "" {
+		return nil, errors.New("missing path")
+	}
+	w := &Writer{
+		precision: conf.Precision,
+		gzip:      conf.Gzip,
+		maxSize:   conf.MaxSize << 20,
+		now:       time.Now,
+	}
+	switch conf.Format {
+	case "", "line":
+		if err := lineprotocol.ValidPrecision(conf.Precision); err != nil {
+			return nil, err
+		}
+	case "json":
+		w.json = true
+	default:
+		return nil, fmt.Errorf("invalid format %s, expected line or json", conf.Format)
+	}
+	if conf.RotateInterval != "" {
+		d, err := time.ParseDuration(conf.RotateInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rotate_interval: %s", err)
+		}
+		w.maxAge = d
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.Path), 0755); err != nil {
+		return nil, err
+	}
+	w.ext = filepath.Ext(conf.Path)
+	w.base = strings.TrimSuffix(conf.Path, w.ext)
+	return w, nil
+}
+
+// Write appends all records to the current file and flushes the file. A new
+// file is started before the write if the current file is larger than
+// max_size or older than rotate_interval, or if the last write failed.
+func (w *Writer) Write(recs []mqlux.Record) error {
+	var buf []byte
+	n := 0
+	for _, rec := range recs {
+		var err error
+		buf, err = w.append(buf, rec)
+		if err != nil {
+			stats.Add("records_dropped", 1)
+			log.Printf("error: dropping record: %s", err)
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.rotate(); err != nil {
+		stats.Add("errors", 1)
+		return err
+	}
+	_, err := w.w.Write(buf)
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		stats.Add("errors", 1)
+		// the buffers may contain partial data, the next write opens a new
+		// file
+		if cerr := w.close(); cerr != nil {
+			log.Printf("debug: closing file after write error: %s", cerr)
+		}
+		return err
+	}
+	w.size += int64(len(buf))
+	stats.Add("records_written", int64(n))
+	return nil
+}
+
+// append appends rec as a single line.
+func (w *Writer) append(b []byte, rec mqlux.Record) ([]byte, error) {
+	if !w.json {
+		return lineprotocol.Append(b, rec, w.precision)
+	}
+	fr := jsonRecord(rec)
+	if len(fr.Fields) == 0 {
+		return b, fmt.Errorf("no valid fields for %s", rec.Measurement)
+	}
+	line, err := json.Marshal(fr)
+	if err != nil {
+		return b, err
+	}
+	b = append(b, line...)
+	return append(b, '\n'), nil
+}
+
+// rotate closes the current file if it is too large or too old and opens a
+// new file if required.
+func (w *Writer) rotate() error {
+	now := w.now()
+	if w.f != nil {
+		tooLarge := w.maxSize > 0 && w.size >= w.maxSize
+		tooOld := w.maxAge > 0 && now.Sub(w.created) >= w.maxAge
+		if !tooLarge && !tooOld {
+			return nil
+		}
+		if err := w.close(); err != nil {
+			return err
+		}
+		stats.Add("files_rotated", 1)
+	}
+
+	name := w.base + "-" + now.UTC().Format(timeFormat) + w.ext
+	if w.gzip {
+		name += ".gz"
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	log.Printf("debug: writing records to %s", name)
+	w.f = f
+	w.buf = bufio.NewWriter(f)
+	w.w = w.buf
+	if w.gzip {
+		w.gz = gzip.NewWriter(w.buf)
+		w.w = w.gz
+	}
+	w.size = 0
+	w.created = now
+	return nil
+}
+
+// flush writes all buffered data to the file. Each flush ends a gzip block,
+// so that all flushed records can be read if mqlux is killed.
+func (w *Writer) flush() error {
+	if w.gz != nil {
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+// close closes the current file.
+func (w *Writer) close() error {
+	f := w.f
+	w.f = nil
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			f.Close()
+			return err
+		}
+		w.gz = nil
+	}
+	if err := w.buf.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Stop closes the current file.
+func (w *Writer) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return
+	}
+	if err := w.close(); err != nil {
+		log.Printf("error: closing file: %s", err)
+	}
+}
+
+type fileRecord struct {
+	Measurement     string                 `json:"measurement"`
+	Tags            map[string]string      `json:"tags,omitempty"`
+	Fields          map[string]interface{} `json:"fields"`
+	Time            string                 `json:"time"`
+	Database        string                 `json:"database,omitempty"`
+	RetentionPolicy string                 `json:"retention_policy,omitempty"`
+}
+
+// jsonRecord converts rec for JSON Lines. Value is stored as value field.
+// Fields with nil, NaN or infinite values are skipped.
+func jsonRecord(rec mqlux.Record) fileRecord {
+	t := rec.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	fields := make(map[string]interface{})
+	for k, v := range rec.FieldValues() {
+		if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			continue
+		}
+		if v != nil {
+			fields[k] = v
+		}
+	}
+	return fileRecord{
+		Measurement:     rec.Measurement,
+		Tags:            rec.Tags,
+		Fields:          fields,
+		Time:            t.UTC().Format(time.RFC3339Nano),
+		Database:        rec.Database,
+		RetentionPolicy: rec.RetentionPolicy,
+	}
+}
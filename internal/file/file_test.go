@@ -0,0 +1,191 @@
+package file
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+var ts = time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)
+
+func record(v float64) mqlux.Record {
+	return mqlux.Record{
+		Measurement: "temperature",
+		Tags:        map[string]string{"room": "kitchen"},
+		Value:       v,
+		Time:        ts,
+	}
+}
+
+// readFiles returns the uncompressed content of all files in dir by name.
+func readFiles(t *testing.T, dir string) map[string]string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make(map[string]string)
+	for _, fi := range files {
+		f, err := os.Open(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b []byte
+		if strings.HasSuffix(fi.Name(), ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err = ioutil.ReadAll(gz)
+		} else {
+			b, err = ioutil.ReadAll(f)
+		}
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content[fi.Name()] = string(b)
+	}
+	return content
+}
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqlux-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := New(config.File{Path: filepath.Join(dir, "archive", "records.lp"), Precision: "s", RotateInterval: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := ts
+	w.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		if err := w.Write([]mqlux.Record{record(float64(i))}); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(40 * time.Minute)
+	}
+	w.Stop()
+
+	files := readFiles(t, filepath.Join(dir, "archive"))
+	want := map[string]string{
+		"records-20180201T120000Z.lp": "temperature,room=kitchen value=0 1517486400\ntemperature,room=kitchen value=1 1517486400\n",
+		"records-20180201T132000Z.lp": "temperature,room=kitchen value=2 1517486400\ntemperature,room=kitchen value=3 1517486400\n",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("unexpected files\n%v\n!=\n%v", files, want)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqlux-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := New(config.File{Path: filepath.Join(dir, "records.lp"), Precision: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := ts
+	w.now = func() time.Time { return now }
+
+	if err := w.Write([]mqlux.Record{record(0)}); err != nil {
+		t.Fatal(err)
+	}
+	// e.g. a failed disk
+	w.f.Close()
+	if err := w.Write([]mqlux.Record{record(1)}); err == nil {
+		t.Fatal("expected error for closed file")
+	}
+	now = now.Add(time.Minute)
+	if err := w.Write([]mqlux.Record{record(2)}); err != nil {
+		t.Fatal(err)
+	}
+	w.Stop()
+
+	files := readFiles(t, dir)
+	want := map[string]string{
+		"records-20180201T120000Z.lp": "temperature,room=kitchen value=0 1517486400\n",
+		"records-20180201T120100Z.lp": "temperature,room=kitchen value=2 1517486400\n",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("unexpected files\n%v\n!=\n%v", files, want)
+	}
+}
+
+func TestGzipJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqlux-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := New(config.File{Path: filepath.Join(dir, "records.jsonl"), Format: "json", Gzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.maxSize = 100
+	now := ts
+	w.now = func() time.Time { return now }
+
+	recs := []mqlux.Record{
+		record(21.5),
+		{Measurement: "status", Fields: map[string]interface{}{"open": true, "message": "ok", "none": nil}, Time: ts, Database: "debug"},
+		{Measurement: "status", Value: nil},
+	}
+	if err := w.Write(recs); err != nil {
+		t.Fatal(err)
+	}
+	// flushed records are readable before the file is closed
+	first := readFiles(t, dir)
+	now = now.Add(time.Second)
+	if err := w.Write(recs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	w.Stop()
+
+	line1 := `{"measurement":"temperature","tags":{"room":"kitchen"},"fields":{"value":21.5},"time":"2018-02-01T12:00:00Z"}` + "\n"
+	line2 := `{"measurement":"status","fields":{"message":"ok","open":true},"time":"2018-02-01T12:00:00Z","database":"debug"}` + "\n"
+	if want := map[string]string{"records-20180201T120000Z.jsonl.gz": line1 + line2}; !reflect.DeepEqual(first, want) {
+		t.Errorf("unexpected files before stop\n%v\n!=\n%v", first, want)
+	}
+	files := readFiles(t, dir)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"records-20180201T120000Z.jsonl.gz", "records-20180201T120001Z.jsonl.gz"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("unexpected files %v", names)
+	}
+	if files[names[1]] != line1 {
+		t.Errorf("unexpected content %q", files[names[1]])
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, conf := range []config.File{
+		{},
+		{Path: "records.lp", Format: "csv"},
+		{Path: "records.lp", Precision: "days"},
+		{Path: "records.lp", RotateInterval: "1 day"},
+	} {
+		if _, err := New(conf); err == nil {
+			t.Errorf("expected error for %v", conf)
+		}
+	}
+}
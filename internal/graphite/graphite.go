@@ -0,0 +1,168 @@
+// Package graphite sends records to Graphite (carbon) with the plaintext
+// protocol over TCP. Records are either mapped to dotted paths or to Graphite
+// 1.1 tagged series.
+package graphite
+
+import (
+	"expvar"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/socket"
+)
+
+// stats exports the number of written metrics and errors as graphite in
+// /debug/vars.
+var stats = expvar.NewMap("graphite")
+
+// Writer sends records to Graphite.
+type Writer struct {
+	conn   *socket.TCPConn
+	prefix string
+	tagged bool
+}
+
+// New creates a new Writer for the address of conf. The connection is
+// established with the first write.
+func New(conf config.Graphite) (*Writer, error) {
+	conn, err := socket.NewTCPConn(conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		conn:   conn,
+		prefix: strings.Trim(conf.Prefix, "."),
+		tagged: conf.Tagged,
+	}, nil
+}
+
+// Write sends all numeric fields of the records. Non-numeric fields are
+// skipped.
+func (w *Writer) Write(recs []mqlux.Record) error {
+	var buf []byte
+	metrics := 0
+	for _, rec := range recs {
+		var n int
+		buf, n = w.append(buf, rec)
+		metrics += n
+	}
+	if metrics == 0 {
+		return nil
+	}
+	if err := w.conn.Send(buf); err != nil {
+		stats.Add("errors", 1)
+		return err
+	}
+	stats.Add("metrics_written", int64(metrics))
+	return nil
+}
+
+// Stop closes the connection.
+func (w *Writer) Stop() {
+	w.conn.Close()
+}
+
+// append appends one line for each numeric field of rec to b and returns the
+// number of lines.
+func (w *Writer) append(b []byte, rec mqlux.Record) ([]byte, int) {
+	n := 0
+	t := rec.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	fields := rec.FieldValues()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, ok := mqlux.Float(fields[name])
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			if fields[name] != nil {
+				stats.Add("metrics_dropped", 1)
+				log.Printf("debug: dropping non-numeric field %s of %s", name, rec.Measurement)
+			}
+			continue
+		}
+		if w.tagged {
+			b = append(b, TaggedPath(w.prefix, rec.Measurement, name, rec.Tags)...)
+		} else {
+			b = append(b, Path(w.prefix, rec.Measurement, name, rec.Tags)...)
+		}
+		b = append(b, ' ')
+		b = strconv.AppendFloat(b, v, 'f', -1, 64)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, t.Unix(), 10)
+		b = append(b, '\n')
+		n++
+	}
+	return b, n
+}
+
+// Path returns the dotted path prefix.measurement.<tag values>.field. Tag
+// values are sorted by the tag name and empty tags are skipped. The field is
+// omitted for the default value field. All components are sanitized.
+func Path(prefix, measurement, field string, tags map[string]string) string {
+	var parts []string
+	if prefix != "" {
+		parts = append(parts, prefix)
+	}
+	parts = append(parts, sanitize(measurement, false))
+	for _, k := range sortedKeys(tags) {
+		parts = append(parts, sanitize(tags[k], false))
+	}
+	if field != "value" {
+		parts = append(parts, sanitize(field, false))
+	}
+	return strings.Join(parts, ".")
+}
+
+// TaggedPath returns a Graphite 1.1 tagged series
+// prefix.measurement.field;tag1=value1;tag2=value2.
+func TaggedPath(prefix, measurement, field string, tags map[string]string) string {
+	name := sanitize(measurement, false)
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+	if field != "value" {
+		name += "." + sanitize(field, false)
+	}
+	for _, k := range sortedKeys(tags) {
+		name += ";" + sanitize(k, false) + "=" + sanitize(tags[k], true)
+	}
+	return name
+}
+
+// sortedKeys returns the sorted keys of all tags with values.
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k == "" || v == "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sanitize replaces all characters except letters, digits, - and _ with _.
+// Dots and colons are kept for tag values.
+func sanitize(s string, tagValue bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case tagValue && (r == '.' || r == ':'):
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,104 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/socket/sockettest"
+)
+
+func TestPath(t *testing.T) {
+	tags := map[string]string{"room": "kitchen", "floor": "1.OG", "empty": ""}
+	for _, test := range []struct {
+		Prefix, Measurement, Field string
+		Tags                       map[string]string
+		Path, Tagged               string
+	}{
+		{Measurement: "temperature", Field: "value", Path: "temperature", Tagged: "temperature"},
+		{
+			Prefix: "mqlux", Measurement: "temperature", Field: "value", Tags: tags,
+			Path:   "mqlux.temperature.1_OG.kitchen",
+			Tagged: "mqlux.temperature;floor=1.OG;room=kitchen",
+		},
+		{
+			Measurement: "power meter", Field: "total.kwh", Tags: map[string]string{"room name": "living;room"},
+			Path:   "power_meter.living_room.total_kwh",
+			Tagged: "power_meter.total_kwh;room_name=living_room",
+		},
+	} {
+		if p := Path(test.Prefix, test.Measurement, test.Field, test.Tags); p != test.Path {
+			t.Errorf("unexpected path %q != %q", p, test.Path)
+		}
+		if p := TaggedPath(test.Prefix, test.Measurement, test.Field, test.Tags); p != test.Tagged {
+			t.Errorf("unexpected tagged path %q != %q", p, test.Tagged)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	s := sockettest.NewServer()
+	defer s.Close()
+
+	ts := time.Unix(1517486400, 0)
+	for _, test := range []struct {
+		Conf config.Graphite
+		Want []string
+	}{
+		{
+			Conf: config.Graphite{Prefix: "mqlux."},
+			Want: []string{
+				"mqlux.climate.kitchen.humidity 40 1517486400",
+				"mqlux.climate.kitchen.open 1 1517486400",
+				"mqlux.climate.kitchen 21.5 1517486400",
+			},
+		},
+		{
+			Conf: config.Graphite{Tagged: true},
+			Want: []string{
+				"climate.humidity;room=kitchen 40 1517486400",
+				"climate.open;room=kitchen 1 1517486400",
+				"climate;room=kitchen 21.5 1517486400",
+			},
+		},
+	} {
+		test.Conf.Address = s.Addr()
+		w, err := New(test.Conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// write twice to use the connection again after it was closed
+		for i := 0; i < 2; i++ {
+			err := w.Write([]mqlux.Record{{
+				Measurement: "climate",
+				Tags:        map[string]string{"room": "kitchen"},
+				Value:       21.5,
+				Fields:      map[string]interface{}{"humidity": 40, "open": true, "status": "ok"},
+				Time:        ts,
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Expect(t, test.Want...)
+			w.Stop()
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	if _, err := New(config.Graphite{}); err == nil {
+		t.Error("expected error without address")
+	}
+	w, err := New(config.Graphite{Address: sockettest.ClosedAddr(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write([]mqlux.Record{{Measurement: "temperature", Value: 1.0}}); err == nil {
+		t.Error("expected error without receiver")
+	}
+	// nothing to send
+	if err := w.Write([]mqlux.Record{{Measurement: "status", Value: "ok"}}); err != nil {
+		t.Error(err)
+	}
+}
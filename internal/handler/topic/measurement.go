@@ -0,0 +1,90 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// measurementTemplate is a measurement name with {name} placeholders
+// (e.g. {kind}_{unit}).
+type measurementTemplate struct {
+	// literals are the strings around the placeholders,
+	// len(literals) == len(names)+1
+	literals []string
+	names    []string
+}
+
+// parseMeasurement parses a measurement name with placeholders.
+// It returns nil if the measurement does not contain any placeholder.
+func parseMeasurement(measurement string) (*measurementTemplate, error) {
+	if !strings.ContainsAny(measurement, "{}") {
+		return nil, nil
+	}
+	m := measurementTemplate{}
+	rest := measurement
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			if strings.IndexByte(rest, '}') >= 0 {
+				return nil, fmt.Errorf("unexpected } in measurement %s", measurement)
+			}
+			m.literals = append(m.literals, rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("missing } in measurement %s", measurement)
+		}
+		end += start
+		name := rest[start+1 : end]
+		if name == "" || strings.ContainsAny(name, "{") {
+			return nil, fmt.Errorf("invalid placeholder in measurement %s", measurement)
+		}
+		if strings.IndexByte(rest[:start], '}') >= 0 {
+			return nil, fmt.Errorf("unexpected } in measurement %s", measurement)
+		}
+		m.literals = append(m.literals, rest[:start])
+		m.names = append(m.names, name)
+		rest = rest[end+1:]
+	}
+	return &m, nil
+}
+
+// expand returns the measurement name with all placeholders replaced.
+// Values are looked up in tags first (named capture groups and static tags)
+// and then in the top-level fields of the payload, if the payload is a JSON
+// object.
+func (m *measurementTemplate) expand(tags map[string]string, payload []byte) (string, error) {
+	var fields map[string]interface{}
+	var buf bytes.Buffer
+	for i, name := range m.names {
+		buf.WriteString(m.literals[i])
+		if v, ok := tags[name]; ok {
+			buf.WriteString(v)
+			continue
+		}
+		if fields == nil {
+			dec := json.NewDecoder(bytes.NewReader(payload))
+			dec.UseNumber()
+			if err := dec.Decode(&fields); err != nil || fields == nil {
+				return "", fmt.Errorf("no tag or payload field for {%s}", name)
+			}
+		}
+		switch v := fields[name].(type) {
+		case string:
+			buf.WriteString(v)
+		case json.Number:
+			buf.WriteString(v.String())
+		case bool:
+			fmt.Fprint(&buf, v)
+		case nil:
+			return "", fmt.Errorf("no tag or payload field for {%s}", name)
+		default:
+			return "", fmt.Errorf("payload field for {%s} is not a string, number or bool", name)
+		}
+	}
+	buf.WriteString(m.literals[len(m.literals)-1])
+	return buf.String(), nil
+}
@@ -0,0 +1,86 @@
+package topic
+
+import (
+	"testing"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/parser"
+)
+
+func TestMeasurementTemplate(t *testing.T) {
+	for _, test := range []struct {
+		Measurement string
+		Tags        map[string]string
+		Payload     string
+		Want        string
+		Error       bool
+	}{
+		{Measurement: "temperature", Want: "temperature"},
+		{Measurement: "{kind}", Tags: map[string]string{"kind": "temperature"}, Want: "temperature"},
+		{
+			Measurement: "{kind}_{unit}",
+			Tags:        map[string]string{"kind": "temperature", "unit": "celsius"},
+			Want:        "temperature_celsius",
+		},
+		{
+			Measurement: "sensor_{kind}_{unit}s",
+			Tags:        map[string]string{"kind": "uptime"},
+			Payload:     `{"unit": "second", "value": 42}`,
+			Want:        "sensor_uptime_seconds",
+		},
+		{
+			Measurement: "{kind}_{version}",
+			Tags:        map[string]string{"kind": "firmware"},
+			Payload:     `{"version": 2}`,
+			Want:        "firmware_2",
+		},
+		{Measurement: "{kind}", Payload: `42`, Error: true},
+		{Measurement: "{kind}", Payload: `{"kind": {"a": 1}}`, Error: true},
+		{Measurement: "{kind}", Payload: `{"unit": "second"}`, Error: true},
+		{Measurement: "{kind", Error: true},
+		{Measurement: "kind}", Error: true},
+		{Measurement: "{}", Error: true},
+	} {
+		m, err := parseMeasurement(test.Measurement)
+		if err != nil {
+			if !test.Error {
+				t.Errorf("parsing %s: %s", test.Measurement, err)
+			}
+			continue
+		}
+		if m == nil {
+			if test.Measurement != test.Want {
+				t.Errorf("%s is not a template", test.Measurement)
+			}
+			continue
+		}
+		actual, err := m.expand(test.Tags, []byte(test.Payload))
+		if (err != nil) != test.Error {
+			t.Errorf("expanding %s: unexpected error %v", test.Measurement, err)
+			continue
+		}
+		if actual != test.Want {
+			t.Errorf("expanding %s: %s != %s", test.Measurement, actual, test.Want)
+		}
+	}
+}
+
+func TestReceiveMeasurementTemplate(t *testing.T) {
+	var recs []mqlux.Record
+	writer := func(r []mqlux.Record) error {
+		recs = append(recs, r...)
+		return nil
+	}
+	rt, err := New(`/net/switch/+/stats/(?P<stat>.+)`, "switch_{stat}", nil, parser.FloatParser, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.Topic() != "/net/switch/+/stats/#" {
+		t.Errorf("unexpected subscribe topic %s", rt.Topic())
+	}
+	rt.Receive(mqlux.Message{Topic: "/net/switch/rack-a/stats/tx_bytes", Payload: []byte("42")})
+	rt.Receive(mqlux.Message{Topic: "/net/switch/rack-b/stats/rx_bytes", Payload: []byte("23")})
+	if len(recs) != 2 || recs[0].Measurement != "switch_tx_bytes" || recs[1].Measurement != "switch_rx_bytes" {
+		t.Errorf("unexpected records %v", recs)
+	}
+}
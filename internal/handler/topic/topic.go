@@ -1,21 +1,29 @@
 package topic
 
 import (
+	"fmt"
 	"log"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/router"
 )
 
 type Topic struct {
 	subscribeTopic  string
 	re              *regexp.Regexp
 	measurement     string
+	measurementTmpl *measurementTemplate
 	tags            map[string]string
 	parser          mqlux.Parser
 	writer          mqlux.Writer
 	includeRetained bool
+	valueField      string
+	database        string
+	retentionPolicy string
+	fieldTypes      string
 }
 
 func New(topic, measurement string, tags map[string]string, parser mqlux.Parser, writer mqlux.Writer) (*Topic, error) {
@@ -26,6 +34,24 @@ func New(topic, measurement string, tags map[string]string, parser mqlux.Parser,
 		writer:      writer,
 	}
 
+	var err error
+	t.measurementTmpl, err = parseMeasurement(measurement)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter, expr, ok, err := templateTopic(topic); ok {
+		if err != nil {
+			return nil, err
+		}
+		t.subscribeTopic = filter
+		t.re, err = regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		return &t, nil
+	}
+
 	st, ok := nonRegexpTopic(topic)
 	if !ok {
 		t.subscribeTopic = topic
@@ -33,6 +59,14 @@ func New(topic, measurement string, tags map[string]string, parser mqlux.Parser,
 	}
 
 	t.subscribeTopic = st
+	// + levels are MQTT wildcards and not regexp quantifiers
+	levels := strings.Split(topic, "/")
+	for i := range levels {
+		if levels[i] == "+" {
+			levels[i] = "[^/]*"
+		}
+	}
+	topic = strings.Join(levels, "/")
 	if !strings.HasSuffix(topic, "$") {
 		topic += "$"
 	}
@@ -48,13 +82,32 @@ func (t *Topic) IncludeRetained(incl bool) {
 	t.includeRetained = incl
 }
 
+// ValueField sets the field name for the Value of all records that have no
+// other Fields. Value is stored as the value field if name is empty.
+func (t *Topic) ValueField(name string) {
+	t.valueField = name
+}
+
+// Target sets the InfluxDB database and retention policy of all records.
+// The database and retention policy of the output are used if empty.
+func (t *Topic) Target(database, retentionPolicy string) {
+	t.database = database
+	t.retentionPolicy = retentionPolicy
+}
+
+// FieldTypes sets the field type policy of all records (reject, coerce or
+// ignore). The InfluxDB outputs handle conflicting values according to policy.
+func (t *Topic) FieldTypes(policy string) {
+	t.fieldTypes = policy
+}
+
 func (t *Topic) Topic() string {
 	return t.subscribeTopic
 }
 
 func (t *Topic) match(topic string) bool {
 	if t.re == nil {
-		return topic == t.subscribeTopic
+		return router.Match(t.subscribeTopic, topic)
 	}
 	return t.re.MatchString(topic)
 }
@@ -68,14 +121,45 @@ func (t *Topic) Receive(msg mqlux.Message) {
 	}
 
 	tags := t.Tags(msg.Topic)
-	records, err := t.parser(msg, t.measurement, tags)
+	measurement := t.measurement
+	if t.measurementTmpl != nil {
+		var err error
+		measurement, err = t.measurementTmpl.expand(tags, msg.Payload)
+		if err != nil {
+			log.Printf("error: measurement for %s: %s", msg.Topic, err)
+			return
+		}
+	}
+	records, err := t.parser(msg, measurement, tags)
 	if err != nil {
 		// TODO logger
 		log.Println("error: parsing ", err)
 		return
 	}
 
-	if records != nil {
+	ts := msg.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	for i := range records {
+		if records[i].Time.IsZero() {
+			records[i].Time = ts
+		}
+		records[i].Database = t.database
+		records[i].RetentionPolicy = t.retentionPolicy
+		records[i].FieldTypes = t.fieldTypes
+	}
+
+	if t.valueField != "" {
+		for i := range records {
+			if len(records[i].Fields) == 0 {
+				records[i].Fields = map[string]interface{}{t.valueField: records[i].Value}
+				records[i].Value = nil
+			}
+		}
+	}
+
+	if len(records) > 0 {
 		err := t.writer(records)
 		if err != nil {
 			// TODO logger
@@ -98,18 +182,23 @@ func (t *Topic) Tags(topic string) map[string]string {
 		tags[k] = v
 	}
 	for i := 1; i < len(sub); i++ {
-		if sub[i] != "" {
+		if sub[i] != "" && tagNames[i] != "" {
 			tags[tagNames[i]] = sub[i]
 		}
 	}
 	return tags
 }
 
+// nonRegexpTopic returns the MQTT topic filter for topic and whether the topic
+// is a regular expression. The filter of a regular expression contains all
+// levels up to the first level with special characters, followed by #.
+// MQTT wildcards (+ and a trailing #) are not regular expressions.
 func nonRegexpTopic(topic string) (string, bool) {
 	nonRegexp := regexp.MustCompile("^[a-zA-Z0-9-_]*$")
 	var result string
-	for _, part := range strings.Split(topic, "/") {
-		if nonRegexp.MatchString(part) {
+	parts := strings.Split(topic, "/")
+	for i, part := range parts {
+		if nonRegexp.MatchString(part) || part == "+" || (part == "#" && i == len(parts)-1) {
 			result += part + "/"
 		} else {
 			return result + "#", true
@@ -117,3 +206,54 @@ func nonRegexpTopic(topic string) (string, bool) {
 	}
 	return topic, false
 }
+
+var (
+	templateName    = regexp.MustCompile(`^\{([a-zA-Z_][a-zA-Z0-9_]*)\}$`)
+	templateLiteral = regexp.MustCompile(`^[^\\()\[\]{}|^$*?+#]*$`)
+)
+
+// templateTopic converts a topic template like /sensors/{location}/+/temp
+// into a MQTT topic filter (/sensors/+/+/temp) and into a regular expression
+// with named groups for each {name} (^/sensors/(?P<location>[^/]*)/[^/]*/temp$).
+// Placeholders need to occupy a whole level. The template can contain the
+// MQTT wildcards + and # as well. ok is false if topic is not a template
+// (e.g. a regular expression or a plain topic without any {name}).
+func templateTopic(topic string) (filter, expr string, ok bool, err error) {
+	levels := strings.Split(topic, "/")
+	filterLevels := make([]string, len(levels))
+	exprLevels := make([]string, len(levels))
+	names := make(map[string]bool)
+	for i, level := range levels {
+		if m := templateName.FindStringSubmatch(level); m != nil {
+			if names[m[1]] {
+				err = fmt.Errorf("duplicate name {%s} in topic %s", m[1], topic)
+			}
+			names[m[1]] = true
+			filterLevels[i] = "+"
+			exprLevels[i] = "(?P<" + m[1] + ">[^/]*)"
+		} else if level == "+" {
+			filterLevels[i] = "+"
+			exprLevels[i] = "[^/]*"
+		} else if level == "#" && i == len(levels)-1 {
+			filterLevels[i] = "#"
+			exprLevels[i] = ""
+		} else if templateLiteral.MatchString(level) {
+			filterLevels[i] = level
+			exprLevels[i] = regexp.QuoteMeta(level)
+		} else {
+			return "", "", false, nil
+		}
+	}
+	if len(names) == 0 {
+		return "", "", false, nil
+	}
+
+	filter = strings.Join(filterLevels, "/")
+	if levels[len(levels)-1] == "#" {
+		// # also matches the parent level (foo/# matches foo)
+		expr = strings.Join(exprLevels[:len(levels)-1], "/") + "(?:/.*)?"
+	} else {
+		expr = strings.Join(exprLevels, "/")
+	}
+	return filter, "^" + expr + "$", true, err
+}
@@ -3,6 +3,10 @@ package topic
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/parser"
 )
 
 func TestMatch(t *testing.T) {
@@ -26,6 +30,23 @@ func TestMatch(t *testing.T) {
 			Topic:         "/net/wlan/ap-1/radio-2/tx",
 			Tags:          map[string]string{"ap": "1", "radio": "2"},
 		},
+		{TopicTemplate: `/sensors/{location}/temperature`, Topic: "/sensors/kitchen/humidity"},
+		{TopicTemplate: `/sensors/{location}/temperature`, Topic: "/sensors/kitchen/dht22/temperature"},
+		{
+			TopicTemplate: `/sensors/{location}/{sensor}/temperature`,
+			Topic:         "/sensors/kitchen/dht22/temperature",
+			Tags:          map[string]string{"location": "kitchen", "sensor": "dht22"},
+		},
+		{
+			TopicTemplate: `tele/{device}/+/#`,
+			Topic:         "tele/sonoff.1/SENSOR/energy/power",
+			Tags:          map[string]string{"device": "sonoff.1"},
+		},
+		{
+			TopicTemplate: `tele/{device}/#`,
+			Topic:         "tele/sonoff",
+			Tags:          map[string]string{"device": "sonoff"},
+		},
 	} {
 		rt, err := New(test.TopicTemplate, "", nil, nil, nil)
 		if err != nil {
@@ -49,6 +70,10 @@ func TestNonRegexpTopic(t *testing.T) {
 		{Topic: "/foo/", Want: "/foo/", IsRegexp: false},
 		{Topic: "/foo/ba[rz]", Want: "/foo/#", IsRegexp: true},
 		{Topic: `/net/wlan/ap-(?P<ap>\d+)/tx`, Want: "/net/wlan/#", IsRegexp: true},
+		{Topic: "/net/+/tx", Want: "/net/+/tx", IsRegexp: false},
+		{Topic: "/net/#", Want: "/net/#", IsRegexp: false},
+		{Topic: "/net/#/tx", Want: "/net/#", IsRegexp: true},
+		{Topic: `/net/\d+/tx`, Want: "/net/#", IsRegexp: true},
 	} {
 		actual, isRegexp := nonRegexpTopic(test.Topic)
 		if test.IsRegexp != isRegexp || actual != test.Want {
@@ -56,3 +81,135 @@ func TestNonRegexpTopic(t *testing.T) {
 		}
 	}
 }
+
+func TestTemplateTopic(t *testing.T) {
+	for _, test := range []struct {
+		Topic      string
+		Filter     string
+		Expr       string
+		IsTemplate bool
+		Error      bool
+	}{
+		{Topic: "/sensors/kitchen/temperature", IsTemplate: false},
+		{Topic: "/sensors/+/temperature", IsTemplate: false},
+		{Topic: `/sensors/(?P<location>[^/]+)/temperature`, IsTemplate: false},
+		{Topic: `/sensors/{location}/\d{2}`, IsTemplate: false},
+		{Topic: `/sensors/room-{location}/temperature`, IsTemplate: false},
+		{
+			Topic:      "/sensors/{location}/temperature",
+			Filter:     "/sensors/+/temperature",
+			Expr:       "^/sensors/(?P<location>[^/]*)/temperature$",
+			IsTemplate: true,
+		},
+		{
+			Topic:      "{device}/sensor.1/+/#",
+			Filter:     "+/sensor.1/+/#",
+			Expr:       `^(?P<device>[^/]*)/sensor\.1/[^/]*(?:/.*)?$`,
+			IsTemplate: true,
+		},
+		{
+			Topic:      "/sensors/{location}/{location}",
+			Filter:     "/sensors/+/+",
+			Expr:       "^/sensors/(?P<location>[^/]*)/(?P<location>[^/]*)$",
+			IsTemplate: true,
+			Error:      true,
+		},
+	} {
+		filter, expr, ok, err := templateTopic(test.Topic)
+		if ok != test.IsTemplate || (err != nil) != test.Error {
+			t.Errorf("topic %s: template=%v error=%v, want template=%v error=%v",
+				test.Topic, ok, err, test.IsTemplate, test.Error)
+			continue
+		}
+		if filter != test.Filter || expr != test.Expr {
+			t.Errorf("topic %s: %s %s != %s %s", test.Topic, filter, expr, test.Filter, test.Expr)
+		}
+	}
+}
+
+func TestValueField(t *testing.T) {
+	var recs []mqlux.Record
+	writer := func(r []mqlux.Record) error {
+		recs = append(recs, r...)
+		return nil
+	}
+	rt, err := New("/sensors/{room}/humidity", "climate", nil, parser.FloatParser, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.ValueField("humidity")
+	rt.Target("longterm", "forever")
+	ts := time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)
+	rt.Receive(mqlux.Message{Topic: "/sensors/kitchen/humidity", Payload: []byte("40"), Time: ts})
+	want := []mqlux.Record{{
+		Measurement:     "climate",
+		Tags:            map[string]string{"room": "kitchen"},
+		Fields:          map[string]interface{}{"humidity": 40.0},
+		Time:            ts,
+		Database:        "longterm",
+		RetentionPolicy: "forever",
+	}}
+	if !reflect.DeepEqual(recs, want) {
+		t.Errorf("unexpected records %v != %v", recs, want)
+	}
+}
+
+func TestRecordTime(t *testing.T) {
+	var recs []mqlux.Record
+	writer := func(r []mqlux.Record) error {
+		recs = append(recs, r...)
+		return nil
+	}
+	msgTime := time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)
+	parserTime := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := func(msg mqlux.Message, measurement string, tags map[string]string) ([]mqlux.Record, error) {
+		return []mqlux.Record{
+			{Measurement: measurement, Value: 1.0},
+			{Measurement: measurement, Value: 2.0, Time: parserTime},
+		}, nil
+	}
+	rt, err := New("/sensors/temperature", "temperature", nil, p, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.Receive(mqlux.Message{Topic: "/sensors/temperature", Time: msgTime})
+	if len(recs) != 2 || !recs[0].Time.Equal(msgTime) || !recs[1].Time.Equal(parserTime) {
+		t.Errorf("unexpected record times %v", recs)
+	}
+
+	recs = nil
+	before := time.Now()
+	rt.Receive(mqlux.Message{Topic: "/sensors/temperature"})
+	if len(recs) != 2 || recs[0].Time.Before(before) || !recs[1].Time.Equal(parserTime) {
+		t.Errorf("unexpected record times %v", recs)
+	}
+}
+
+func TestFieldTypes(t *testing.T) {
+	var recs []mqlux.Record
+	writer := func(r []mqlux.Record) error {
+		recs = append(recs, r...)
+		return nil
+	}
+	p := func(msg mqlux.Message, measurement string, tags map[string]string) ([]mqlux.Record, error) {
+		return []mqlux.Record{{Measurement: measurement, Value: string(msg.Payload)}}, nil
+	}
+	rt, err := New("/sensors/status", "status", nil, p, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.FieldTypes("coerce")
+
+	// values are checked by the InfluxDB outputs, not by the handler
+	ts := time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)
+	rt.Receive(mqlux.Message{Topic: "/sensors/status", Payload: []byte("online"), Time: ts})
+	want := []mqlux.Record{{
+		Measurement: "status",
+		Value:       "online",
+		Time:        ts,
+		FieldTypes:  "coerce",
+	}}
+	if !reflect.DeepEqual(recs, want) {
+		t.Errorf("unexpected records %v != %v", recs, want)
+	}
+}
@@ -0,0 +1,353 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/retry"
+)
+
+// testServer records the query and body of all write requests.
+type testServer struct {
+	*httptest.Server
+	queries []string
+	bodies  []string
+}
+
+func newTestServer() *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.queries = append(s.queries, r.URL.RawQuery)
+		s.bodies = append(s.bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func TestWriteTime(t *testing.T) {
+	for _, test := range []struct {
+		Precision string
+		Want      string
+	}{
+		{Precision: "", Want: "temperature,room=kitchen value=21.5 1517486400123456789\n"},
+		{Precision: "ms", Want: "temperature,room=kitchen value=21.5 1517486400123\n"},
+		{Precision: "s", Want: "temperature,room=kitchen value=21.5 1517486400\n"},
+	} {
+		s := newTestServer()
+		conf := config.InfluxDB{}
+		conf.URL = s.URL
+		conf.Database = "test"
+		conf.Precision = test.Precision
+		db, err := NewInfluxDBClient(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Write([]mqlux.Record{{
+			Measurement: "temperature",
+			Tags:        map[string]string{"room": "kitchen"},
+			Value:       21.5,
+			Time:        time.Unix(1517486400, 123456789),
+		}})
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.bodies) != 1 || s.bodies[0] != test.Want {
+			t.Errorf("unexpected body %q != %q", s.bodies, test.Want)
+		}
+		if test.Precision != "" && !strings.Contains(s.queries[0], "precision="+test.Precision) {
+			t.Errorf("precision %s missing in query %s", test.Precision, s.queries[0])
+		}
+	}
+}
+
+func TestInvalidPrecision(t *testing.T) {
+	conf := config.InfluxDB{}
+	conf.URL = "http://localhost:8086"
+	conf.Precision = "days"
+	if _, err := NewInfluxDBClient(conf); err == nil {
+		t.Error("expected error for invalid precision")
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	var mu sync.Mutex
+	var written []string
+	failures := 2
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "bad") {
+			http.Error(w, `{"error":"field type conflict"}`, http.StatusBadRequest)
+			return
+		}
+		written = append(written, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	deadLetter, err := ioutil.TempFile("", "mqlux-dead-letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetter.Close()
+	defer os.Remove(deadLetter.Name())
+
+	conf := config.InfluxDB{}
+	conf.URL = s.URL
+	conf.Database = "test"
+	conf.DeadLetterFile = deadLetter.Name()
+	db, err := NewInfluxDBClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.backoff = retry.Backoff{Attempts: 3, Min: time.Millisecond, Max: time.Millisecond}
+
+	ts := time.Unix(1517486400, 0)
+	err = db.Write([]mqlux.Record{
+		{Measurement: "temperature", Value: 21.5, Time: ts},
+		{Measurement: "bad", Value: "21.5", Time: ts},
+		{Measurement: "humidity", Value: 40.0, Time: ts},
+		{Measurement: "pressure", Value: 1013.0, Time: ts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"temperature value=21.5 1517486400000000000",
+		"humidity value=40 1517486400000000000",
+		"pressure value=1013 1517486400000000000",
+	}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("unexpected points %q != %q", written, want)
+	}
+	dropped, _ := ioutil.ReadFile(deadLetter.Name())
+	if !strings.Contains(string(dropped), "\nbad value=\"21.5\" 1517486400000000000\n") {
+		t.Errorf("dropped point missing in dead letter file: %s", dropped)
+	}
+
+	// transient errors are returned after all retries
+	mu.Lock()
+	failures = 3
+	mu.Unlock()
+	err = db.Write([]mqlux.Record{{Measurement: "temperature", Value: 21.5, Time: ts}})
+	if err == nil || retry.IsPermanent(err) {
+		t.Errorf("expected transient error, got %v", err)
+	}
+}
+
+func TestWriteAuthError(t *testing.T) {
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, `{"error":"authorization failed"}`, http.StatusUnauthorized)
+	}))
+	defer s.Close()
+
+	conf := config.InfluxDB{}
+	conf.URL = s.URL
+	conf.Database = "test"
+	db, err := NewInfluxDBClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.backoff = retry.Backoff{Attempts: 3, Min: time.Millisecond, Max: time.Millisecond}
+
+	var recs []mqlux.Record
+	for i := 0; i < 8; i++ {
+		recs = append(recs, mqlux.Record{Measurement: "temperature", Value: float64(i)})
+	}
+	// the error is returned for the whole batch (e.g. to spool it) without
+	// splitting or retrying the batch
+	if err := db.Write(recs); retry.StatusCode(err) != http.StatusUnauthorized {
+		t.Errorf("expected authorization error, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("unexpected number of requests %d", requests)
+	}
+}
+
+func TestWriteTargets(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+	conf := config.InfluxDB{}
+	conf.URL = s.URL
+	conf.Database = "sensors"
+	conf.RetentionPolicy = "one_week"
+	db, err := NewInfluxDBClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Unix(1517486400, 0)
+	err = db.Write([]mqlux.Record{
+		{Measurement: "temperature", Value: 21.5, Time: ts},
+		{Measurement: "power", Value: 230.0, Time: ts, Database: "longterm"},
+		{Measurement: "humidity", Value: 40.0, Time: ts},
+		{Measurement: "power", Value: 231.0, Time: ts, Database: "longterm"},
+		{Measurement: "debug", Value: 1.0, Time: ts, RetentionPolicy: "one_day"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantQueries := []string{"db=sensors&rp=one_week", "db=longterm", "db=sensors&rp=one_day"}
+	wantBodies := []string{
+		"temperature value=21.5 1517486400000000000\nhumidity value=40 1517486400000000000\n",
+		"power value=230 1517486400000000000\npower value=231 1517486400000000000\n",
+		"debug value=1 1517486400000000000\n",
+	}
+	if !reflect.DeepEqual(s.queries, wantQueries) {
+		t.Errorf("unexpected queries %q != %q", s.queries, wantQueries)
+	}
+	if !reflect.DeepEqual(s.bodies, wantBodies) {
+		t.Errorf("unexpected bodies %q != %q", s.bodies, wantBodies)
+	}
+}
+
+func TestWriteFieldTypes(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+	conf := config.InfluxDB{}
+	conf.URL = s.URL
+	conf.Database = "sensors"
+	db, err := NewInfluxDBClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Unix(1517486400, 0)
+	// the type of a field is known after the first successful write
+	if err := db.Write([]mqlux.Record{{Measurement: "status", Value: 1.0, Time: ts}}); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Write([]mqlux.Record{
+		{Measurement: "status", Value: "online", Time: ts},
+		{Measurement: "status", Value: "2", Time: ts, FieldTypes: "coerce"},
+		// field types are tracked per database
+		{Measurement: "status", Value: "online", Time: ts, Database: "events"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantBodies := []string{
+		"status value=1 1517486400000000000\n",
+		"status value=2 1517486400000000000\n",
+		"status value=\"online\" 1517486400000000000\n",
+	}
+	if !reflect.DeepEqual(s.bodies, wantBodies) {
+		t.Errorf("unexpected bodies %q != %q", s.bodies, wantBodies)
+	}
+}
+
+func TestWriteV2(t *testing.T) {
+	var path, query, auth, encoding, body string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		query = r.URL.RawQuery
+		auth = r.Header.Get("Authorization")
+		encoding = r.Header.Get("Content-Encoding")
+		var reader io.Reader = r.Body
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			reader = zr
+		}
+		data, _ := ioutil.ReadAll(reader)
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	conf := config.InfluxDB{}
+	conf.URL = s.URL
+	conf.Org = "ktt"
+	conf.Bucket = "sensors"
+	conf.Token = "secret"
+	conf.Precision = "u"
+	conf.Gzip = true
+	db, err := NewInfluxDBClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Write([]mqlux.Record{{
+		Measurement: "temperature",
+		Tags:        map[string]string{"room": "kitchen"},
+		Value:       21.5,
+		Time:        time.Unix(1517486400, 123456789),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/api/v2/write" || query != "bucket=sensors&org=ktt&precision=us" {
+		t.Errorf("unexpected request %s?%s", path, query)
+	}
+	if auth != "Token secret" || encoding != "gzip" {
+		t.Errorf("unexpected headers %s %s", auth, encoding)
+	}
+	if body != "temperature,room=kitchen value=21.5 1517486400123456\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// database overrides the bucket
+	err = db.Write([]mqlux.Record{{Measurement: "power", Value: 230.0, Database: "longterm"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "bucket=longterm&org=ktt&precision=us" {
+		t.Errorf("unexpected query %s", query)
+	}
+
+	// retention policies are mapped to <bucket>/<rp>
+	for _, test := range []struct {
+		rec   mqlux.Record
+		query string
+	}{
+		{mqlux.Record{Measurement: "power", Value: 230.0, RetentionPolicy: "one_week"}, "bucket=sensors%2Fone_week&org=ktt&precision=us"},
+		{mqlux.Record{Measurement: "power", Value: 230.0, Database: "longterm", RetentionPolicy: "forever"}, "bucket=longterm%2Fforever&org=ktt&precision=us"},
+	} {
+		if err := db.Write([]mqlux.Record{test.rec}); err != nil {
+			t.Fatal(err)
+		}
+		if query != test.query {
+			t.Errorf("unexpected query %s != %s", query, test.query)
+		}
+	}
+}
+
+func TestConfigV2(t *testing.T) {
+	conf := config.InfluxDB{}
+	conf.URL = "http://localhost:8086"
+	conf.Token = "secret"
+	if _, err := NewInfluxDBClient(conf); err == nil {
+		t.Error("expected error for missing org and bucket")
+	}
+	conf.Org = "ktt"
+	conf.Bucket = "sensors"
+	conf.Precision = "h"
+	if _, err := NewInfluxDBClient(conf); err == nil {
+		t.Error("expected error for unsupported precision")
+	}
+}
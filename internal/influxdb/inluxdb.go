@@ -1,67 +1,356 @@
 package influxdb
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/influxdb/influxdb/client"
 	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/fieldtype"
+	"github.com/ktt-ol/mqlux/internal/lineprotocol"
 	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/retry"
 )
 
+// stats exports the number of written points and write errors as influxdb in
+// /debug/vars.
+var stats = expvar.NewMap("influxdb")
+
 type InfluxDBClient struct {
-	client          *client.Client
+	url             url.URL
+	username        string
+	password        string
+	httpClient      *http.Client
 	database        string
 	retentionPolicy string
+	precision       string
+	backoff         retry.Backoff
+	gzip            bool
+	// fieldTypes tracks the field types of all seeded and written points
+	fieldTypes *fieldtype.Tracker
+	// targets are the default target and all additional targets, without
+	// duplicates
+	targets []target
+
+	// InfluxDB 2.x
+	v2     bool
+	org    string
+	bucket string
+	token  string
+
+	deadLetter   *os.File
+	deadLetterMu sync.Mutex
 }
 
-func NewInfluxDBClient(conf config.Config) (*InfluxDBClient, error) {
-	clientCfg := client.NewConfig()
-	u, err := url.Parse(conf.InfluxDB.URL)
-	if err != nil {
+// Target is a database and retention policy that records are written to
+// (e.g. the Database and RetentionPolicy of a subscription). Empty values
+// default to the configured database and retention policy.
+type Target struct {
+	Database        string
+	RetentionPolicy string
+}
+
+// NewInfluxDBClient creates a new client. With create_database, the
+// databases of the configuration and of all targets are created.
+func NewInfluxDBClient(conf config.InfluxDB, targets ...Target) (*InfluxDBClient, error) {
+	if err := lineprotocol.ValidPrecision(conf.Precision); err != nil {
 		return nil, err
 	}
-	clientCfg.URL = *u
-	clientCfg.Username = conf.InfluxDB.Username
-	clientCfg.Password = conf.InfluxDB.Password
 
-	c, err := client.NewClient(clientCfg)
+	v2 := conf.Token != "" || conf.Org != "" || conf.Bucket != ""
+	if v2 {
+		if conf.Org == "" || conf.Bucket == "" {
+			return nil, errors.New("org and bucket are required for InfluxDB 2.x")
+		}
+		if conf.Precision == "m" || conf.Precision == "h" {
+			return nil, fmt.Errorf("precision %s is not supported by InfluxDB 2.x", conf.Precision)
+		}
+	}
+
+	u, err := url.Parse(conf.URL)
 	if err != nil {
 		return nil, err
 	}
 
-	return &InfluxDBClient{
-		client:          c,
-		database:        conf.InfluxDB.Database,
-		retentionPolicy: conf.InfluxDB.RetentionPolicy,
-	}, nil
+	i := &InfluxDBClient{
+		url:             *u,
+		username:        conf.Username,
+		password:        conf.Password,
+		httpClient:      &http.Client{Timeout: client.DefaultTimeout},
+		database:        conf.Database,
+		retentionPolicy: conf.RetentionPolicy,
+		precision:       conf.Precision,
+		backoff:         retry.DefaultBackoff(retry.Attempts(conf.Retries)),
+		gzip:            conf.Gzip,
+		fieldTypes:      fieldtype.New(),
+		v2:              v2,
+		org:             conf.Org,
+		bucket:          conf.Bucket,
+		token:           conf.Token,
+	}
+	i.targets = []target{i.target(mqlux.Record{})}
+	for _, t := range targets {
+		tgt := i.target(mqlux.Record{Database: t.Database, RetentionPolicy: t.RetentionPolicy})
+		if !containsTarget(i.targets, tgt) {
+			i.targets = append(i.targets, tgt)
+		}
+	}
+
+	if conf.CreateDatabase {
+		if v2 {
+			return nil, errors.New("create_database is not supported for InfluxDB 2.x")
+		}
+		if err := i.provision(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.DeadLetterFile != "" {
+		i.deadLetter, err = os.OpenFile(conf.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
 }
 
+// Write writes all records. Records are grouped by their Database and
+// RetentionPolicy, which default to the configured database and retention
+// policy. Values that conflict with the known type of their field are
+// handled according to the FieldTypes policy of the record. The field types
+// of all written points are tracked. Transient errors
+// (network errors, server errors) are retried. Points that are rejected by
+// InfluxDB (e.g. because of a field type conflict) are dropped individually,
+// all other points of the batch are written.
 func (i *InfluxDBClient) Write(recs []mqlux.Record) error {
-	pts := make([]client.Point, len(recs))
-	for i, rec := range recs {
-		pts[i] = client.Point{
-			Measurement: rec.Measurement,
-			Fields: map[string]interface{}{
-				"value": rec.Value,
-			},
-			Tags: rec.Tags,
-			Time: time.Now(),
-		}
-	}
-	return i.writePoints(pts)
+	var targets []target
+	points := make(map[target][]point)
+	for _, rec := range recs {
+		tgt := i.target(rec)
+		rec, ok := i.fieldTypes.Check(tgt.database, rec)
+		if !ok {
+			continue
+		}
+		line, err := lineprotocol.String(rec, i.precision)
+		if err != nil {
+			stats.Add("points_dropped", 1)
+			log.Printf("error: dropping record: %s", err)
+			continue
+		}
+		if _, ok := points[tgt]; !ok {
+			targets = append(targets, tgt)
+		}
+		points[tgt] = append(points[tgt], point{line: line, rec: rec})
+	}
+
+	var firstErr error
+	for _, tgt := range targets {
+		if err := i.writePoints(tgt, points[tgt]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// point is a record in line protocol.
+type point struct {
+	line string
+	rec  mqlux.Record
+}
+
+// target is the database and retention policy of a write request. For
+// InfluxDB 2.x, database is the bucket.
+type target struct {
+	database        string
+	retentionPolicy string
+}
+
+func (i *InfluxDBClient) target(rec mqlux.Record) target {
+	if i.v2 {
+		database := rec.Database
+		if database == "" {
+			database = i.bucket
+		}
+		if rec.RetentionPolicy != "" {
+			// bucket naming of the InfluxDB 1.x compatibility API
+			return target{database: database + "/" + rec.RetentionPolicy}
+		}
+		return target{database: database}
+	}
+	if rec.Database == "" && rec.RetentionPolicy == "" {
+		return target{database: i.database, retentionPolicy: i.retentionPolicy}
+	}
+	t := target{database: rec.Database, retentionPolicy: rec.RetentionPolicy}
+	if t.database == "" {
+		t.database = i.database
+	}
+	return t
+}
+
+// writePoints writes the points and tracks the field types of the written
+// points. It splits the batch to find all points that are rejected, if
+// InfluxDB rejects the batch because of invalid points. Other errors are
+// returned, so that the batch can be spooled.
+func (i *InfluxDBClient) writePoints(tgt target, points []point) error {
+	lines := make([]string, len(points))
+	for n, p := range points {
+		lines[n] = p.line
+	}
+	err := i.backoff.Do(func() error {
+		return i.post(tgt, lines)
+	}, func(err error, delay time.Duration) {
+		stats.Add("retries", 1)
+		log.Printf("warning: writing %d points to %s, retrying in %s: %s", len(lines), tgt, delay, err)
+	})
+	if err == nil {
+		stats.Add("points_written", int64(len(lines)))
+		for _, p := range points {
+			i.fieldTypes.Learn(tgt.database, p.rec)
+		}
+		return nil
+	}
+	if !retry.IsPermanent(err) {
+		stats.Add("errors_transient", 1)
+		return err
+	}
+
+	stats.Add("errors_permanent", 1)
+	if !rejectsPoints(err) {
+		// e.g. invalid credentials or a missing database, the same for all
+		// points
+		return err
+	}
+	if len(points) == 1 {
+		i.drop(tgt, lines[0], err)
+		return nil
+	}
+	mid := len(points) / 2
+	if err := i.writePoints(tgt, points[:mid]); err != nil {
+		return err
+	}
+	return i.writePoints(tgt, points[mid:])
+}
+
+// rejectsPoints checks whether InfluxDB rejected the batch because of some of
+// its points (e.g. a field type conflict or a batch that is too large). All
+// other permanent errors (e.g. 401, 403 or 404) apply to every point.
+func rejectsPoints(err error) bool {
+	switch retry.StatusCode(err) {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+func containsTarget(targets []target, t target) bool {
+	for _, other := range targets {
+		if other == t {
+			return true
+		}
+	}
+	return false
 }
 
-func (i *InfluxDBClient) writePoints(pts []client.Point) error {
-	bps := client.BatchPoints{
-		Points:          pts,
-		Database:        i.database,
-		RetentionPolicy: i.retentionPolicy,
+func (t target) String() string {
+	if t.retentionPolicy == "" {
+		return t.database
 	}
+	return t.database + "." + t.retentionPolicy
+}
 
-	_, err := i.client.Write(bps)
+// drop logs a rejected point and appends it to the dead letter file.
+func (i *InfluxDBClient) drop(tgt target, line string, err error) {
+	stats.Add("points_dropped", 1)
+	log.Printf("error: dropping point %s for %s: %s", line, tgt, err)
+	if i.deadLetter == nil {
+		return
+	}
+	i.deadLetterMu.Lock()
+	defer i.deadLetterMu.Unlock()
+	_, werr := fmt.Fprintf(i.deadLetter, "# %s: %s\n%s\n", tgt, strings.Replace(err.Error(), "\n", " ", -1), line)
+	if werr != nil {
+		log.Println("error: writing dead letter file", werr)
+	}
+}
+
+// post sends the points to the /write endpoint (or /api/v2/write for
+// InfluxDB 2.x).
+func (i *InfluxDBClient) post(tgt target, lines []string) error {
+	u := i.url
+	params := url.Values{}
+	if i.v2 {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		params.Set("org", i.org)
+		params.Set("bucket", tgt.database)
+		if i.precision == "u" {
+			params.Set("precision", "us")
+		} else if i.precision != "" {
+			params.Set("precision", i.precision)
+		}
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		params.Set("db", tgt.database)
+		if tgt.retentionPolicy != "" {
+			params.Set("rp", tgt.retentionPolicy)
+		}
+		if i.precision != "" {
+			params.Set("precision", i.precision)
+		}
+	}
+	u.RawQuery = params.Encode()
+
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var zw *gzip.Writer
+	if i.gzip {
+		zw = gzip.NewWriter(&body)
+		w = zw
+	}
+	for _, line := range lines {
+		io.WriteString(w, line)
+		io.WriteString(w, "\n")
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return retry.Permanent(err)
+		}
+	}
+
+	req, err := http.NewRequest("POST", u.String(), &body)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if i.token != "" {
+		req.Header.Set("Authorization", "Token "+i.token)
+	} else if i.username != "" {
+		req.SetBasicAuth(i.username, i.password)
+	}
+
+	resp, err := i.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return retry.StatusError(resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
 	return nil
 }
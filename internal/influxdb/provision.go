@@ -0,0 +1,362 @@
+package influxdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/fieldtype"
+	"github.com/ktt-ol/mqlux/internal/retry"
+)
+
+// retentionPolicy is the configured or existing retention policy of a
+// database.
+type retentionPolicy struct {
+	name        string
+	duration    time.Duration // 0 for infinite
+	replication int
+	isDefault   bool
+}
+
+// provision creates the databases of all targets if they do not exist. The
+// configured retention policy is created on each database that it is used
+// with. Other retention policies of the targets can not be created without
+// a duration, mqlux only warns if they do not exist. Differences between an
+// existing and the configured retention policy are logged, but the policy is
+// not altered.
+func (i *InfluxDBClient) provision(conf config.InfluxDB) error {
+	if i.database == "" {
+		return fmt.Errorf("create_database requires database")
+	}
+	createRP := conf.RetentionPolicy != "" && conf.RetentionDuration != ""
+	want := retentionPolicy{
+		name:        conf.RetentionPolicy,
+		replication: conf.RetentionReplication,
+		isDefault:   conf.RetentionDefault,
+	}
+	if want.replication == 0 {
+		want.replication = 1
+	}
+	if createRP {
+		var err error
+		want.duration, err = parseDuration(conf.RetentionDuration)
+		if err != nil {
+			return fmt.Errorf("invalid retention_duration: %s", err)
+		}
+	}
+
+	created := make(map[string]bool)
+	for _, tgt := range i.targets {
+		if !created[tgt.database] {
+			log.Printf("debug: creating database %s", tgt.database)
+			if _, err := i.query("CREATE DATABASE " + quoteIdent(tgt.database)); err != nil {
+				return err
+			}
+			created[tgt.database] = true
+		}
+		if tgt.retentionPolicy == "" {
+			continue
+		}
+		if tgt.retentionPolicy == want.name && createRP {
+			if err := i.createRetentionPolicy(tgt.database, want); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := i.checkRetentionPolicy(tgt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createRetentionPolicy creates the retention policy on database if it does
+// not exist.
+func (i *InfluxDBClient) createRetentionPolicy(database string, want retentionPolicy) error {
+	policies, err := i.retentionPolicies(database)
+	if err != nil {
+		return err
+	}
+	for _, rp := range policies {
+		if rp.name != want.name {
+			continue
+		}
+		for _, d := range rp.drift(want) {
+			log.Printf("warning: retention policy %s on %s differs from configuration: %s", want.name, database, d)
+		}
+		return nil
+	}
+
+	q := fmt.Sprintf("CREATE RETENTION POLICY %s ON %s DURATION %s REPLICATION %d",
+		quoteIdent(want.name), quoteIdent(database), formatDuration(want.duration), want.replication)
+	if want.isDefault {
+		q += " DEFAULT"
+	}
+	log.Printf("info: creating retention policy %s on %s", want.name, database)
+	_, err = i.query(q)
+	return err
+}
+
+// checkRetentionPolicy logs a warning if the retention policy of tgt does
+// not exist.
+func (i *InfluxDBClient) checkRetentionPolicy(tgt target) error {
+	policies, err := i.retentionPolicies(tgt.database)
+	if err != nil {
+		return err
+	}
+	for _, rp := range policies {
+		if rp.name == tgt.retentionPolicy {
+			return nil
+		}
+	}
+	log.Printf("warning: retention policy %s does not exist on %s and has no retention_duration", tgt.retentionPolicy, tgt.database)
+	return nil
+}
+
+// drift returns all differences between the existing policy rp and the
+// configured policy.
+func (rp retentionPolicy) drift(configured retentionPolicy) []string {
+	var result []string
+	if rp.duration != configured.duration {
+		result = append(result, fmt.Sprintf("duration is %s, configured %s",
+			formatDuration(rp.duration), formatDuration(configured.duration)))
+	}
+	if rp.replication != configured.replication {
+		result = append(result, fmt.Sprintf("replication is %d, configured %d", rp.replication, configured.replication))
+	}
+	if configured.isDefault && !rp.isDefault {
+		result = append(result, "policy is not the default policy")
+	}
+	return result
+}
+
+// retentionPolicies returns all retention policies of the database.
+func (i *InfluxDBClient) retentionPolicies(database string) ([]retentionPolicy, error) {
+	results, err := i.query("SHOW RETENTION POLICIES ON " + quoteIdent(database))
+	if err != nil {
+		return nil, err
+	}
+	var policies []retentionPolicy
+	for _, res := range results {
+		for _, s := range res.Series {
+			col := make(map[string]int)
+			for j, c := range s.Columns {
+				col[c] = j
+			}
+			for _, row := range s.Values {
+				var rp retentionPolicy
+				var duration string
+				if err := row.get(col, "name", &rp.name); err != nil {
+					return nil, err
+				}
+				if err := row.get(col, "duration", &duration); err != nil {
+					return nil, err
+				}
+				if rp.duration, err = parseDuration(duration); err != nil {
+					return nil, err
+				}
+				var replicaN float64
+				if err := row.get(col, "replicaN", &replicaN); err != nil {
+					return nil, err
+				}
+				rp.replication = int(replicaN)
+				if err := row.get(col, "default", &rp.isDefault); err != nil {
+					return nil, err
+				}
+				policies = append(policies, rp)
+			}
+		}
+	}
+	return policies, nil
+}
+
+// SeedFieldTypes loads the types of all fields of the databases of all
+// targets (SHOW FIELD KEYS), so that conflicting values are detected before
+// they are written. All databases are seeded, the first error is returned.
+func (i *InfluxDBClient) SeedFieldTypes() error {
+	if i.v2 {
+		return errors.New("seed_field_types is not supported for InfluxDB 2.x")
+	}
+	var firstErr error
+	seeded := make(map[string]bool)
+	for _, tgt := range i.targets {
+		if tgt.database == "" || seeded[tgt.database] {
+			continue
+		}
+		seeded[tgt.database] = true
+		if err := i.seedFieldTypes(tgt.database); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", tgt.database, err)
+		}
+	}
+	return firstErr
+}
+
+func (i *InfluxDBClient) seedFieldTypes(database string) error {
+	results, err := i.query("SHOW FIELD KEYS ON " + quoteIdent(database))
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, res := range results {
+		for _, s := range res.Series {
+			col := make(map[string]int)
+			for j, c := range s.Columns {
+				col[c] = j
+			}
+			for _, row := range s.Values {
+				var field, typeName string
+				if err := row.get(col, "fieldKey", &field); err != nil {
+					return err
+				}
+				if err := row.get(col, "fieldType", &typeName); err != nil {
+					return err
+				}
+				typ, err := fieldtype.ParseType(typeName)
+				if err != nil {
+					return err
+				}
+				i.fieldTypes.Seed(database, s.Name, field, typ)
+				n++
+			}
+		}
+	}
+	log.Printf("debug: loaded %d field types from %s", n, database)
+	return nil
+}
+
+// queryResult is a single statement result of the /query endpoint.
+type queryResult struct {
+	Error  string `json:"error"`
+	Series []struct {
+		Name    string     `json:"name"`
+		Columns []string   `json:"columns"`
+		Values  []queryRow `json:"values"`
+	} `json:"series"`
+}
+
+type queryRow []interface{}
+
+// get stores the value of the named column in v.
+func (r queryRow) get(columns map[string]int, name string, v interface{}) error {
+	j, ok := columns[name]
+	if !ok || j >= len(r) {
+		return fmt.Errorf("column %s missing in query result", name)
+	}
+	var valid bool
+	switch v := v.(type) {
+	case *string:
+		*v, valid = r[j].(string)
+	case *float64:
+		*v, valid = r[j].(float64)
+	case *bool:
+		*v, valid = r[j].(bool)
+	}
+	if !valid {
+		return fmt.Errorf("unexpected type %T for column %s", r[j], name)
+	}
+	return nil
+}
+
+// query executes the statement with the /query endpoint. Transient errors
+// are retried, e.g. while InfluxDB is still starting.
+func (i *InfluxDBClient) query(q string) ([]queryResult, error) {
+	var results []queryResult
+	err := i.backoff.Do(func() error {
+		var err error
+		results, err = i.postQuery(q)
+		return err
+	}, func(err error, delay time.Duration) {
+		log.Printf("warning: query %s, retrying in %s: %s", q, delay, err)
+	})
+	return results, err
+}
+
+func (i *InfluxDBClient) postQuery(q string) ([]queryResult, error) {
+	u := i.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/query"
+	req, err := http.NewRequest("POST", u.String(), strings.NewReader(url.Values{"q": {q}}.Encode()))
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if i.username != "" {
+		req.SetBasicAuth(i.username, i.password)
+	}
+
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, retry.StatusError(resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Error   string        `json:"error"`
+		Results []queryResult `json:"results"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, retry.Permanent(fmt.Errorf("invalid query response: %s", err))
+	}
+	if result.Error != "" {
+		return nil, retry.Permanent(fmt.Errorf("query %s: %s", q, result.Error))
+	}
+	for _, res := range result.Results {
+		if res.Error != "" {
+			return nil, retry.Permanent(fmt.Errorf("query %s: %s", q, res.Error))
+		}
+	}
+	return result.Results, nil
+}
+
+// quoteIdent quotes an identifier for InfluxQL.
+func quoteIdent(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// parseDuration parses InfluxQL durations (e.g. 30d, 1w, 12h or INF) and the
+// durations returned by SHOW RETENTION POLICIES (e.g. 720h0m0s). Infinite
+// durations are returned as 0.
+func parseDuration(s string) (time.Duration, error) {
+	if strings.EqualFold(s, "INF") {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	// InfluxQL supports d and w units, but not combined units
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseInt(strings.TrimSuffix(s, suffix), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %s", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid duration %s", s)
+}
+
+// formatDuration formats d as InfluxQL duration.
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "INF"
+	}
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
@@ -0,0 +1,254 @@
+package influxdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+// queryServer is a minimal stand-in for the /query endpoint that supports
+// CREATE DATABASE, SHOW RETENTION POLICIES and CREATE RETENTION POLICY.
+type queryServer struct {
+	*httptest.Server
+	queries []string
+	// policies are the rows of SHOW RETENTION POLICIES by database
+	policies map[string][][]interface{}
+}
+
+func newQueryServer() *queryServer {
+	s := &queryServer{policies: make(map[string][][]interface{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.FormValue("q")
+		s.queries = append(s.queries, q)
+		result := map[string]interface{}{"statement_id": 0}
+		switch {
+		case strings.HasPrefix(q, `CREATE DATABASE "`):
+			db := strings.Trim(strings.TrimPrefix(q, "CREATE DATABASE "), `"`)
+			if _, ok := s.policies[db]; !ok {
+				s.policies[db] = [][]interface{}{{"autogen", "0s", "168h0m0s", 1, true}}
+			}
+		case strings.HasPrefix(q, "SHOW RETENTION POLICIES ON "):
+			db := strings.Trim(strings.TrimPrefix(q, "SHOW RETENTION POLICIES ON "), `"`)
+			result["series"] = []interface{}{map[string]interface{}{
+				"columns": []string{"name", "duration", "shardGroupDuration", "replicaN", "default"},
+				"values":  s.policies[db],
+			}}
+		case strings.HasPrefix(q, "CREATE RETENTION POLICY "):
+			// only the statements created by provision are supported
+			fields := strings.Fields(q)
+			name, db := strings.Trim(fields[3], `"`), strings.Trim(fields[5], `"`)
+			d, _ := parseDuration(fields[7])
+			replication, _ := strconv.Atoi(fields[9])
+			isDefault := len(fields) > 10
+			s.policies[db] = append(s.policies[db], []interface{}{name, d.String(), "24h0m0s", replication, isDefault})
+		case strings.HasPrefix(q, "SHOW FIELD KEYS ON "):
+			result["series"] = []interface{}{
+				map[string]interface{}{
+					"name":    "temperature",
+					"columns": []string{"fieldKey", "fieldType"},
+					"values":  [][]string{{"value", "float"}},
+				},
+				map[string]interface{}{
+					"name":    "door",
+					"columns": []string{"fieldKey", "fieldType"},
+					"values":  [][]string{{"open", "boolean"}, {"count", "integer"}},
+				},
+			}
+		default:
+			result["error"] = "unsupported query " + q
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []interface{}{result}})
+	}))
+	return s
+}
+
+func TestProvision(t *testing.T) {
+	s := newQueryServer()
+	defer s.Close()
+
+	conf := config.InfluxDB{
+		URL:               s.URL,
+		Database:          "sensors",
+		RetentionPolicy:   "one_year",
+		CreateDatabase:    true,
+		RetentionDuration: "52w",
+		RetentionDefault:  true,
+	}
+	if _, err := NewInfluxDBClient(conf); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`CREATE DATABASE "sensors"`,
+		`SHOW RETENTION POLICIES ON "sensors"`,
+		`CREATE RETENTION POLICY "one_year" ON "sensors" DURATION 8736h REPLICATION 1 DEFAULT`,
+	}
+	if !reflect.DeepEqual(s.queries, want) {
+		t.Errorf("unexpected queries %q != %q", s.queries, want)
+	}
+
+	// second start does not create the policy again
+	s.queries = nil
+	if _, err := NewInfluxDBClient(conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.queries) != 2 {
+		t.Errorf("unexpected queries %q", s.queries)
+	}
+
+	// drift is reported
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	conf.RetentionDuration = "30d"
+	if _, err := NewInfluxDBClient(conf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "retention policy one_year on sensors differs from configuration: duration is 8736h, configured 720h") {
+		t.Errorf("drift not reported: %s", buf.String())
+	}
+}
+
+func TestProvisionTargets(t *testing.T) {
+	s := newQueryServer()
+	defer s.Close()
+
+	conf := config.InfluxDB{
+		URL:               s.URL,
+		Database:          "sensors",
+		CreateDatabase:    true,
+		RetentionPolicy:   "one_year",
+		RetentionDuration: "52w",
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	_, err := NewInfluxDBClient(conf,
+		Target{Database: "longterm", RetentionPolicy: "one_year"},
+		Target{Database: "events"},
+		Target{RetentionPolicy: "autogen"},
+		Target{Database: "events", RetentionPolicy: "one_week"},
+		// the default target
+		Target{Database: "sensors", RetentionPolicy: "one_year"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`CREATE DATABASE "sensors"`,
+		`SHOW RETENTION POLICIES ON "sensors"`,
+		`CREATE RETENTION POLICY "one_year" ON "sensors" DURATION 8736h REPLICATION 1`,
+		`CREATE DATABASE "longterm"`,
+		`SHOW RETENTION POLICIES ON "longterm"`,
+		`CREATE RETENTION POLICY "one_year" ON "longterm" DURATION 8736h REPLICATION 1`,
+		`CREATE DATABASE "events"`,
+		`SHOW RETENTION POLICIES ON "sensors"`,
+		`SHOW RETENTION POLICIES ON "events"`,
+	}
+	if !reflect.DeepEqual(s.queries, want) {
+		t.Errorf("unexpected queries\n%q\n!=\n%q", s.queries, want)
+	}
+	if !strings.Contains(buf.String(), "retention policy one_week does not exist on events") {
+		t.Errorf("missing retention policy not reported: %s", buf.String())
+	}
+}
+
+func TestProvisionErrors(t *testing.T) {
+	s := newQueryServer()
+	defer s.Close()
+
+	conf := config.InfluxDB{
+		URL:               s.URL,
+		Database:          "sensors",
+		RetentionPolicy:   "one_year",
+		CreateDatabase:    true,
+		RetentionDuration: "one year",
+	}
+	if _, err := NewInfluxDBClient(conf); err == nil {
+		t.Error("expected error for invalid duration")
+	}
+
+	conf.RetentionDuration = ""
+	conf.Database = ""
+	if _, err := NewInfluxDBClient(conf); err == nil {
+		t.Error("expected error for missing database")
+	}
+
+	conf.Database = "sensors"
+	conf.Org = "ktt"
+	conf.Bucket = "sensors"
+	if _, err := NewInfluxDBClient(conf); err == nil {
+		t.Error("expected error for InfluxDB 2.x")
+	}
+}
+
+func TestSeedFieldTypes(t *testing.T) {
+	s := newQueryServer()
+	defer s.Close()
+	db, err := NewInfluxDBClient(config.InfluxDB{URL: s.URL, Database: "sensors"}, Target{Database: "events"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SeedFieldTypes(); err != nil {
+		t.Fatal(err)
+	}
+	wantQueries := []string{`SHOW FIELD KEYS ON "sensors"`, `SHOW FIELD KEYS ON "events"`}
+	if !reflect.DeepEqual(s.queries, wantQueries) {
+		t.Errorf("unexpected queries %q != %q", s.queries, wantQueries)
+	}
+	for _, database := range []string{"sensors", "events"} {
+		var recs []mqlux.Record
+		for _, rec := range []mqlux.Record{
+			{Measurement: "temperature", Value: "n/a"},
+			{Measurement: "door", Fields: map[string]interface{}{"open": true, "count": 1.5}},
+		} {
+			if rec, ok := db.fieldTypes.Check(database, rec); ok {
+				recs = append(recs, rec)
+			}
+		}
+		want := []mqlux.Record{
+			{Measurement: "door", Fields: map[string]interface{}{"open": true}},
+		}
+		if !reflect.DeepEqual(recs, want) {
+			t.Errorf("unexpected records for %s %v != %v", database, recs, want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"INF":      0,
+		"0s":       0,
+		"30d":      30 * 24 * time.Hour,
+		"2w":       14 * 24 * time.Hour,
+		"12h":      12 * time.Hour,
+		"720h0m0s": 720 * time.Hour,
+	} {
+		d, err := parseDuration(s)
+		if err != nil {
+			t.Error(err)
+		}
+		if d != want {
+			t.Errorf("parseDuration(%s) = %s, want %s", s, d, want)
+		}
+	}
+	for _, s := range []string{"", "1y", "d", "1.5d"} {
+		if _, err := parseDuration(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
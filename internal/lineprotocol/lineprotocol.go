@@ -0,0 +1,167 @@
+// Package lineprotocol encodes records in the InfluxDB line protocol.
+package lineprotocol
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// ValidPrecision checks whether precision is supported by Append.
+func ValidPrecision(precision string) error {
+	switch precision {
+	case "", "ns", "u", "ms", "s", "m", "h":
+		return nil
+	}
+	return fmt.Errorf("invalid precision %s, expected ns, u, ms, s, m or h", precision)
+}
+
+// Append appends the record as a single line (including the trailing
+// newline) to b. Tags and fields are sorted by key. Tags with empty values
+// and fields with nil, NaN or infinite values are skipped. The timestamp is
+// written in the given precision (ns, u, ms, s, m or h; defaults to ns). The
+// current time is used if the record has no time.
+// b is returned unmodified with an error if the record can not be
+// encoded (e.g. because it has no valid fields).
+func Append(b []byte, rec mqlux.Record, precision string) ([]byte, error) {
+	if rec.Measurement == "" {
+		return b, errors.New("record without measurement")
+	}
+	if strings.ContainsAny(rec.Measurement, "\n\r") {
+		return b, fmt.Errorf("newline in measurement %q", rec.Measurement)
+	}
+	start := len(b)
+	b = append(b, measurementEscaper.Replace(rec.Measurement)...)
+
+	keys := make([]string, 0, len(rec.Tags))
+	for k, v := range rec.Tags {
+		if k == "" || v == "" {
+			continue
+		}
+		if strings.ContainsAny(k, "\n\r") || strings.ContainsAny(v, "\n\r") {
+			return b[:start], fmt.Errorf("newline in tag %q=%q", k, v)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b = append(b, ',')
+		b = append(b, keyEscaper.Replace(k)...)
+		b = append(b, '=')
+		b = append(b, keyEscaper.Replace(rec.Tags[k])...)
+	}
+
+	fields := rec.FieldValues()
+	keys = keys[:0]
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sep := byte(' ')
+	for _, k := range keys {
+		if k == "" || strings.ContainsAny(k, "\n\r") {
+			return b[:start], fmt.Errorf("invalid field name %q", k)
+		}
+		n := len(b)
+		b = append(b, sep)
+		b = append(b, keyEscaper.Replace(k)...)
+		b = append(b, '=')
+		var ok bool
+		b, ok = appendValue(b, fields[k])
+		if !ok {
+			// skip field
+			b = b[:n]
+			continue
+		}
+		sep = ','
+	}
+	if sep == ' ' {
+		return b[:start], fmt.Errorf("no valid fields for %s", rec.Measurement)
+	}
+
+	t := rec.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, t.UnixNano()/precisionUnit(precision), 10)
+	return append(b, '\n'), nil
+}
+
+// String returns the record as a single line without trailing newline.
+func String(rec mqlux.Record, precision string) (string, error) {
+	b, err := Append(nil, rec, precision)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:len(b)-1]), nil
+}
+
+func appendValue(b []byte, v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return b, false
+		}
+		return strconv.AppendFloat(b, v, 'f', -1, 64), true
+	case float32:
+		return appendValue(b, float64(v))
+	case int:
+		return append(strconv.AppendInt(b, int64(v), 10), 'i'), true
+	case int8:
+		return append(strconv.AppendInt(b, int64(v), 10), 'i'), true
+	case int16:
+		return append(strconv.AppendInt(b, int64(v), 10), 'i'), true
+	case int32:
+		return append(strconv.AppendInt(b, int64(v), 10), 'i'), true
+	case int64:
+		return append(strconv.AppendInt(b, v, 10), 'i'), true
+	case uint:
+		return append(strconv.AppendUint(b, uint64(v), 10), 'i'), true
+	case uint8:
+		return append(strconv.AppendUint(b, uint64(v), 10), 'i'), true
+	case uint16:
+		return append(strconv.AppendUint(b, uint64(v), 10), 'i'), true
+	case uint32:
+		return append(strconv.AppendUint(b, uint64(v), 10), 'i'), true
+	case bool:
+		return strconv.AppendBool(b, v), true
+	case string:
+		b = append(b, '"')
+		b = append(b, stringEscaper.Replace(v)...)
+		return append(b, '"'), true
+	case nil:
+		return b, false
+	}
+	b = append(b, '"')
+	b = append(b, stringEscaper.Replace(fmt.Sprint(v))...)
+	return append(b, '"'), true
+}
+
+func precisionUnit(precision string) int64 {
+	switch precision {
+	case "u":
+		return int64(time.Microsecond)
+	case "ms":
+		return int64(time.Millisecond)
+	case "s":
+		return int64(time.Second)
+	case "m":
+		return int64(time.Minute)
+	case "h":
+		return int64(time.Hour)
+	}
+	return 1
+}
@@ -0,0 +1,89 @@
+package lineprotocol
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+func TestString(t *testing.T) {
+	ts := time.Unix(1517486400, 123456789)
+	for _, test := range []struct {
+		Record    mqlux.Record
+		Precision string
+		Want      string
+	}{
+		{
+			Record: mqlux.Record{Measurement: "temperature", Tags: map[string]string{"room": "kitchen", "floor": "1"}, Value: 21.5, Time: ts},
+			Want:   "temperature,floor=1,room=kitchen value=21.5 1517486400123456789",
+		},
+		{
+			Record:    mqlux.Record{Measurement: "temperature", Value: 21.5, Time: ts},
+			Precision: "ms",
+			Want:      "temperature value=21.5 1517486400123",
+		},
+		{
+			Record:    mqlux.Record{Measurement: "temperature", Value: 21.5, Time: ts},
+			Precision: "h",
+			Want:      "temperature value=21.5 421524",
+		},
+		{
+			Record: mqlux.Record{Measurement: "power meter,1", Tags: map[string]string{"room name": "living=room,1", "empty": ""}, Value: 1e6, Time: ts},
+			Want:   `power\ meter\,1,room\ name=living\=room\,1 value=1000000 1517486400123456789`,
+		},
+		{
+			Record: mqlux.Record{Measurement: "status", Fields: map[string]interface{}{
+				"message": "door \"open\"\nC:\\",
+				"open":    true,
+				"count":   42,
+				"field 1": int64(-1),
+				"none":    nil,
+				"nan":     math.NaN(),
+				"inf":     math.Inf(1),
+			}, Time: ts},
+			Want: `status count=42i,field\ 1=-1i,message="door \"open\"` + "\n" + `C:\\",open=true 1517486400123456789`,
+		},
+	} {
+		actual, err := String(test.Record, test.Precision)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if actual != test.Want {
+			t.Errorf("unexpected line\n%s\n!=\n%s", actual, test.Want)
+		}
+	}
+}
+
+func TestInvalidRecords(t *testing.T) {
+	for _, rec := range []mqlux.Record{
+		{Value: 1.0},
+		{Measurement: "temperature", Value: nil},
+		{Measurement: "temperature", Value: math.NaN()},
+		{Measurement: "temp\nerature", Value: 1.0},
+		{Measurement: "temperature", Tags: map[string]string{"room": "kit\nchen"}, Value: 1.0},
+	} {
+		b, err := Append([]byte("prefix"), rec, "")
+		if err == nil {
+			t.Errorf("expected error for %v", rec)
+		}
+		if string(b) != "prefix" {
+			t.Errorf("buffer modified for invalid record %v: %q", rec, b)
+		}
+	}
+}
+
+func TestAppendTime(t *testing.T) {
+	b, err := Append(nil, mqlux.Record{Measurement: "temperature", Value: 1.0}, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 10 || b[len(b)-1] != '\n' {
+		t.Errorf("unexpected line %q", b)
+	}
+	if err := ValidPrecision("days"); err == nil {
+		t.Error("expected error for invalid precision")
+	}
+}
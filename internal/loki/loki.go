@@ -0,0 +1,305 @@
+// Package loki pushes string fields (e.g. door events, status messages or log
+// lines) to the push API of Grafana Loki.
+package loki
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/prometheus"
+	"github.com/ktt-ol/mqlux/internal/retry"
+)
+
+// stats exports the number of pushed entries and errors as loki in
+// /debug/vars.
+var stats = expvar.NewMap("loki")
+
+// streamExpiry is the time after which the latest timestamp of a stream is
+// forgotten if nothing was pushed to the stream. Newer entries are accepted
+// by Loki anyway, and Loki only accepts older entries within its
+// out-of-order window (max_chunk_age / 2, 1h by default).
+const streamExpiry = time.Hour
+
+// Stream is a set of log entries with the same labels.
+type Stream struct {
+	Labels map[string]string `json:"stream"`
+	// Values are pairs of the timestamp in nanoseconds (as string) and the
+	// log line.
+	Values [][2]string `json:"values"`
+}
+
+type pushRequest struct {
+	Streams []Stream `json:"streams"`
+}
+
+// Writer pushes records to Loki.
+type Writer struct {
+	url        string
+	username   string
+	password   string
+	tenantID   string
+	labels     map[string]string
+	httpClient *http.Client
+	backoff    retry.Backoff
+
+	mu sync.Mutex
+	// last is the latest pushed entry by streamKey
+	last map[string]lastEntry
+	// expired is the time of the last removal of expired streams from last
+	expired time.Time
+	// now is replaced in tests
+	now func() time.Time
+}
+
+type lastEntry struct {
+	timestamp int64
+	pushed    time.Time
+}
+
+// New creates a new Writer. /loki/api/v1/push is used if the URL of conf has
+// no path.
+func New(conf config.Loki) (*Writer, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("loki url requires http or https scheme")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/loki/api/v1/push"
+	}
+
+	labels := make(map[string]string, len(conf.Labels))
+	for k, v := range conf.Labels {
+		name := prometheus.LabelName(k)
+		if reserved(name) {
+			return nil, fmt.Errorf("label %s is reserved", k)
+		}
+		labels[name] = v
+	}
+
+	return &Writer{
+		url:        u.String(),
+		username:   conf.Username,
+		password:   conf.Password,
+		tenantID:   conf.TenantID,
+		labels:     labels,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		backoff:    retry.DefaultBackoff(retry.Attempts(conf.Retries)),
+		last:       make(map[string]lastEntry),
+		now:        time.Now,
+	}, nil
+}
+
+// reserved checks whether the label name is set by mqlux for each stream.
+func reserved(name string) bool {
+	return name == "measurement" || name == "field"
+}
+
+// Write pushes all string fields of the records. Records without string
+// fields are skipped. Entries that are older than the latest pushed entry of
+// their stream are dropped, as Loki rejects the whole push otherwise. Streams
+// are forgotten if nothing was pushed to them for streamExpiry.
+func (w *Writer) Write(recs []mqlux.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	streams := w.dropOutOfOrder(w.Streams(recs))
+	if len(streams) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(pushRequest{Streams: streams})
+	if err != nil {
+		return err
+	}
+	entries := 0
+	for _, s := range streams {
+		entries += len(s.Values)
+	}
+
+	err = w.backoff.Do(func() error {
+		return w.post(body)
+	}, func(err error, delay time.Duration) {
+		stats.Add("retries", 1)
+		log.Printf("warning: loki push of %d entries, retrying in %s: %s", entries, delay, err)
+	})
+	if err != nil {
+		stats.Add("errors", 1)
+		return err
+	}
+	stats.Add("entries_written", int64(entries))
+	now := w.now()
+	for _, s := range streams {
+		w.last[streamKey(s.Labels)] = lastEntry{timestamp: timestamp(s.Values[len(s.Values)-1][0]), pushed: now}
+	}
+	if now.Sub(w.expired) > streamExpiry {
+		for key, e := range w.last {
+			if now.Sub(e.pushed) > streamExpiry {
+				delete(w.last, key)
+			}
+		}
+		w.expired = now
+	}
+	return nil
+}
+
+// dropOutOfOrder removes all entries that are older than the latest pushed
+// entry of their stream. Streams without entries are removed.
+func (w *Writer) dropOutOfOrder(streams []Stream) []Stream {
+	result := streams[:0]
+	for _, s := range streams {
+		last, ok := w.last[streamKey(s.Labels)]
+		if !ok {
+			result = append(result, s)
+			continue
+		}
+		values := s.Values[:0]
+		for _, v := range s.Values {
+			if timestamp(v[0]) < last.timestamp {
+				stats.Add("entries_dropped", 1)
+				log.Printf("warning: dropping loki entry %q of %s, older than the last pushed entry", v[1], s.Labels["measurement"])
+				continue
+			}
+			values = append(values, v)
+		}
+		if len(values) > 0 {
+			s.Values = values
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// Streams groups the string fields of all records by their labels. The
+// labels of each stream are the configured labels, the tags, the
+// measurement and (for fields other than value) the field name. Tags named
+// measurement or field are prefixed with tag_. The entries of each stream
+// are sorted by time, as Loki rejects out-of-order entries.
+func (w *Writer) Streams(recs []mqlux.Record) []Stream {
+	var streams []Stream
+	index := make(map[string]int)
+	for _, rec := range recs {
+		t := rec.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		ts := strconv.FormatInt(t.UnixNano(), 10)
+
+		fields := rec.FieldValues()
+		names := make([]string, 0, len(fields))
+		for name, v := range fields {
+			if _, ok := v.(string); ok {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			stats.Add("records_skipped", 1)
+			continue
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			labels := w.streamLabels(rec, name)
+			key := streamKey(labels)
+			i, ok := index[key]
+			if !ok {
+				i = len(streams)
+				index[key] = i
+				streams = append(streams, Stream{Labels: labels})
+			}
+			streams[i].Values = append(streams[i].Values, [2]string{ts, fields[name].(string)})
+		}
+	}
+	for _, s := range streams {
+		values := s.Values
+		sort.SliceStable(values, func(i, j int) bool {
+			return timestamp(values[i][0]) < timestamp(values[j][0])
+		})
+	}
+	return streams
+}
+
+func (w *Writer) streamLabels(rec mqlux.Record, field string) map[string]string {
+	labels := make(map[string]string, len(w.labels)+len(rec.Tags)+2)
+	for k, v := range w.labels {
+		labels[k] = v
+	}
+	for k, v := range rec.Tags {
+		if k == "" || v == "" {
+			continue
+		}
+		name := prometheus.LabelName(k)
+		if reserved(name) {
+			name = "tag_" + name
+		}
+		labels[name] = v
+	}
+	labels["measurement"] = rec.Measurement
+	if field != "value" {
+		labels["field"] = field
+	}
+	return labels
+}
+
+// streamKey returns a unique key for labels.
+func streamKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(labels[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func timestamp(s string) int64 {
+	ts, _ := strconv.ParseInt(s, 10, 64)
+	return ts
+}
+
+func (w *Writer) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mqlux")
+	if w.tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", w.tenantID)
+	}
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return retry.StatusError(resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package loki
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+var ts = time.Unix(1517486400, 0)
+
+var records = []mqlux.Record{
+	{Measurement: "door", Tags: map[string]string{"room": "space", "door-id": "1"}, Value: "open", Time: ts.Add(2 * time.Second)},
+	{Measurement: "door", Tags: map[string]string{"room": "space", "door-id": "1"}, Value: "closed", Time: ts},
+	{Measurement: "temperature", Tags: map[string]string{"room": "space"}, Value: 21.5, Time: ts},
+	{Measurement: "status", Fields: map[string]interface{}{"message": "ok", "code": 200}, Time: ts.Add(time.Second)},
+}
+
+func TestStreams(t *testing.T) {
+	w, err := New(config.Loki{URL: "http://localhost:3100", Labels: map[string]string{"job": "mqlux"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Stream{
+		{
+			Labels: map[string]string{"job": "mqlux", "measurement": "door", "room": "space", "door_id": "1"},
+			Values: [][2]string{{"1517486400000000000", "closed"}, {"1517486402000000000", "open"}},
+		},
+		{
+			Labels: map[string]string{"job": "mqlux", "measurement": "status", "field": "message"},
+			Values: [][2]string{{"1517486401000000000", "ok"}},
+		},
+	}
+	if actual := w.Streams(records); !reflect.DeepEqual(actual, want) {
+		t.Errorf("unexpected streams\n%v\n!=\n%v", actual, want)
+	}
+}
+
+func TestReservedLabels(t *testing.T) {
+	w, err := New(config.Loki{URL: "http://localhost:3100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := w.Streams([]mqlux.Record{{
+		Measurement: "status",
+		Tags:        map[string]string{"measurement": "door", "field": "main"},
+		Value:       "open",
+		Time:        ts,
+	}})
+	want := []Stream{{
+		Labels: map[string]string{"measurement": "status", "tag_measurement": "door", "tag_field": "main"},
+		Values: [][2]string{{"1517486400000000000", "open"}},
+	}}
+	if !reflect.DeepEqual(streams, want) {
+		t.Errorf("unexpected streams\n%v\n!=\n%v", streams, want)
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	var requests []pushRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req pushRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, req)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := New(config.Loki{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	door := func(value string, t time.Time) mqlux.Record {
+		return mqlux.Record{Measurement: "door", Value: value, Time: t}
+	}
+	if err := w.Write([]mqlux.Record{door("open", ts.Add(time.Second))}); err != nil {
+		t.Fatal(err)
+	}
+	// the older entry of the next batch is dropped
+	err = w.Write([]mqlux.Record{
+		door("closed", ts),
+		door("locked", ts.Add(time.Second)),
+		{Measurement: "status", Value: "ok", Time: ts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing left to push
+	if err := w.Write([]mqlux.Record{door("closed", ts)}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Stream{
+		{Labels: map[string]string{"measurement": "door"}, Values: [][2]string{{"1517486401000000000", "locked"}}},
+		{Labels: map[string]string{"measurement": "status"}, Values: [][2]string{{"1517486400000000000", "ok"}}},
+	}
+	if len(requests) != 2 || !reflect.DeepEqual(requests[1].Streams, want) {
+		t.Errorf("unexpected requests %v", requests)
+	}
+}
+
+func TestStreamExpiry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := New(config.Loki{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := ts
+	w.now = func() time.Time { return now }
+	// a new stream for each write, for 5 hours
+	for i := 0; i < 300; i++ {
+		rec := mqlux.Record{Measurement: "door", Tags: map[string]string{"id": strconv.Itoa(i)}, Value: "open", Time: now}
+		if err := w.Write([]mqlux.Record{rec}); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Minute)
+	}
+	// streams are removed once per streamExpiry
+	if n := len(w.last); n > 2*int(streamExpiry/time.Minute)+1 {
+		t.Errorf("expired streams not removed, %d streams left", n)
+	}
+}
+
+func TestPush(t *testing.T) {
+	var requests []pushRequest
+	fail := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/push" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if tenant := r.Header.Get("X-Scope-OrgID"); tenant != "sensors" {
+			t.Errorf("unexpected tenant %q", tenant)
+		}
+		if user, pass, _ := r.BasicAuth(); user != "mqlux" || pass != "secret" {
+			t.Errorf("unexpected credentials %s:%s", user, pass)
+		}
+		if fail > 0 {
+			fail--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var req pushRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, req)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := New(config.Loki{URL: srv.URL, Username: "mqlux", Password: "secret", TenantID: "sensors"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backoff.Min = time.Millisecond
+	if err := w.Write(records); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || !reflect.DeepEqual(requests[0].Streams, w.Streams(records)) {
+		t.Errorf("unexpected requests %v", requests)
+	}
+
+	// nothing to push
+	if err := w.Write(records[2:3]); err != nil {
+		t.Error(err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("unexpected request for numeric records")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, conf := range []config.Loki{
+		{},
+		{URL: "localhost:3100"},
+		{URL: "http://localhost:3100", Labels: map[string]string{"measurement": "door"}},
+	} {
+		if _, err := New(conf); err == nil {
+			t.Errorf("expected error for %v", conf)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "entry out of order", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	w, err := New(config.Loki{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(records); err == nil {
+		t.Error("expected error for bad request")
+	}
+}
@@ -14,7 +14,58 @@ type Message struct {
 type Record struct {
 	Measurement string
 	Tags        map[string]string
-	Value       interface{}
+	// Value is the default field of the record (stored as value).
+	Value interface{}
+	// Fields stores additional named fields.
+	Fields map[string]interface{}
+	// Time of the record. Defaults to the time of the message.
+	Time time.Time
+	// Database and RetentionPolicy override the target of the InfluxDB
+	// output (optional).
+	Database        string
+	RetentionPolicy string
+	// FieldTypes is the policy of the InfluxDB output for values that
+	// conflict with the known field type (reject, coerce or ignore). Defaults
+	// to reject.
+	FieldTypes string
+}
+
+// FieldValues returns all fields of the record. Value is returned as
+// the value field, unless Value is nil and the record has other Fields.
+func (r Record) FieldValues() map[string]interface{} {
+	if len(r.Fields) == 0 {
+		return map[string]interface{}{"value": r.Value}
+	}
+	if r.Value == nil {
+		return r.Fields
+	}
+	fields := make(map[string]interface{}, len(r.Fields)+1)
+	fields["value"] = r.Value
+	for k, v := range r.Fields {
+		fields[k] = v
+	}
+	return fields
+}
+
+// Float converts numeric and boolean field values to float64. Booleans are
+// converted to 0 and 1. ok is false for all other values.
+func Float(v interface{}) (f float64, ok bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
 }
 
 // Parser converts one Message into zero or more Records.
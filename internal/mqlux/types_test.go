@@ -0,0 +1,28 @@
+package mqlux
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFieldValues(t *testing.T) {
+	for _, test := range []struct {
+		Record Record
+		Want   map[string]interface{}
+	}{
+		{Record: Record{Value: 42.0}, Want: map[string]interface{}{"value": 42.0}},
+		{Record: Record{}, Want: map[string]interface{}{"value": nil}},
+		{
+			Record: Record{Fields: map[string]interface{}{"temperature": 21.5, "humidity": 40.0}},
+			Want:   map[string]interface{}{"temperature": 21.5, "humidity": 40.0},
+		},
+		{
+			Record: Record{Value: true, Fields: map[string]interface{}{"temperature": 21.5}},
+			Want:   map[string]interface{}{"value": true, "temperature": 21.5},
+		},
+	} {
+		if actual := test.Record.FieldValues(); !reflect.DeepEqual(actual, test.Want) {
+			t.Errorf("unexpected fields for %v: %v != %v", test.Record, actual, test.Want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package mqtt
+
+import (
+	"sort"
+	"strings"
+)
+
+// minimalFilters returns the sorted set of filters that are required to
+// receive all messages for the given filters. Duplicate filters and filters
+// that are covered by a wildcard filter (e.g. /foo/bar by /foo/#) are removed.
+// Overlapping filters (e.g. /foo/+/baz and /foo/bar/#) are replaced by a
+// common wildcard filter (/foo/+/#), as the broker can deliver a message
+// once for each matching subscription.
+func minimalFilters(filters []string) []string {
+	unique := make(map[string]struct{}, len(filters))
+	for _, f := range filters {
+		unique[f] = struct{}{}
+	}
+
+	for merged := true; merged; {
+		merged = false
+	pairs:
+		for a := range unique {
+			for b := range unique {
+				if a != b && !covers(a, b) && !covers(b, a) && overlaps(a, b) {
+					delete(unique, a)
+					delete(unique, b)
+					unique[join(a, b)] = struct{}{}
+					merged = true
+					break pairs
+				}
+			}
+		}
+	}
+
+	var result []string
+	for f := range unique {
+		covered := false
+		for other := range unique {
+			if other != f && covers(other, f) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, f)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// overlaps checks whether at least one topic is matched by filter a and b.
+func overlaps(a, b string) bool {
+	ap := strings.Split(a, "/")
+	bp := strings.Split(b, "/")
+
+	// wildcards at the first level do not match topics starting with $
+	if isWildcard(ap[0]) && strings.HasPrefix(bp[0], "$") ||
+		isWildcard(bp[0]) && strings.HasPrefix(ap[0], "$") {
+		return false
+	}
+
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		if ap[i] == "#" || bp[i] == "#" {
+			return true
+		}
+		if ap[i] != bp[i] && ap[i] != "+" && bp[i] != "+" {
+			return false
+		}
+	}
+	if len(ap) == len(bp) {
+		return true
+	}
+	// # also matches the parent level (foo/# matches foo)
+	if len(ap) == len(bp)+1 {
+		return ap[len(bp)] == "#"
+	}
+	if len(bp) == len(ap)+1 {
+		return bp[len(ap)] == "#"
+	}
+	return false
+}
+
+// join returns a filter that covers the overlapping filters a and b.
+// Different levels are replaced by +, a # or a different number of levels
+// by #.
+func join(a, b string) string {
+	ap := strings.Split(a, "/")
+	bp := strings.Split(b, "/")
+	var levels []string
+	for i := 0; ; i++ {
+		if i == len(ap) && i == len(bp) {
+			break
+		}
+		if i >= len(ap) || i >= len(bp) || ap[i] == "#" || bp[i] == "#" {
+			levels = append(levels, "#")
+			break
+		}
+		if ap[i] == bp[i] {
+			levels = append(levels, ap[i])
+		} else {
+			levels = append(levels, "+")
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+func isWildcard(level string) bool {
+	return level == "#" || level == "+"
+}
+
+// covers checks whether all topics matched by filter b are also matched by
+// filter a.
+func covers(a, b string) bool {
+	ap := strings.Split(a, "/")
+	bp := strings.Split(b, "/")
+
+	// wildcards at the first level do not match topics starting with $
+	if isWildcard(ap[0]) && strings.HasPrefix(bp[0], "$") {
+		return false
+	}
+
+	for i := range ap {
+		if ap[i] == "#" {
+			// # also matches the parent level (foo/# matches foo)
+			return true
+		}
+		if i >= len(bp) || bp[i] == "#" {
+			return false
+		}
+		if ap[i] == "+" {
+			continue
+		}
+		if ap[i] != bp[i] {
+			return false
+		}
+	}
+	return len(ap) == len(bp)
+}
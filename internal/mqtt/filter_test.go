@@ -0,0 +1,107 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCovers(t *testing.T) {
+	for _, test := range []struct {
+		a, b   string
+		covers bool
+	}{
+		{a: "/foo", b: "/foo", covers: true},
+		{a: "/foo", b: "/bar", covers: false},
+		{a: "/foo", b: "/foo/bar", covers: false},
+		{a: "/#", b: "/foo/bar", covers: true},
+		{a: "/#", b: "/", covers: true},
+		{a: "/#", b: "foo/bar", covers: false},
+		{a: "#", b: "foo/bar", covers: true},
+		{a: "#", b: "/foo/#", covers: true},
+		{a: "#", b: "$SYS/broker/uptime", covers: false},
+		{a: "+/#", b: "$SYS/#", covers: false},
+		{a: "$SYS/#", b: "$SYS/broker/uptime", covers: true},
+		{a: "/foo/#", b: "/foo", covers: true},
+		{a: "/foo/#", b: "/foo/bar/baz", covers: true},
+		{a: "/foo/bar", b: "/foo/#", covers: false},
+		{a: "/foo/+", b: "/foo/bar", covers: true},
+		{a: "/foo/+", b: "/foo/+", covers: true},
+		{a: "/foo/+", b: "/foo/bar/baz", covers: false},
+		{a: "/foo/+", b: "/foo/#", covers: false},
+		{a: "/foo/bar", b: "/foo/+", covers: false},
+		{a: "/+/+/temp", b: "/sensors/kitchen/temp", covers: true},
+		{a: "/+/+/temp", b: "/sensors/+/humidity", covers: false},
+		{a: "/+/#", b: "/sensors/+/temp", covers: true},
+	} {
+		if actual := covers(test.a, test.b); actual != test.covers {
+			t.Errorf("covers(%q, %q) = %v, want %v", test.a, test.b, actual, test.covers)
+		}
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		overlaps bool
+		join     string
+	}{
+		{a: "/a/+/c", b: "/a/b/#", overlaps: true, join: "/a/+/#"},
+		{a: "/a/+/c", b: "/a/b/+", overlaps: true, join: "/a/+/+"},
+		{a: "/a/+", b: "/a/b/#", overlaps: true, join: "/a/+/#"},
+		{a: "/a/+/c", b: "/a/b/d", overlaps: false},
+		{a: "/a/+/c", b: "/a/b", overlaps: false},
+		{a: "/a/+/c", b: "/a/b/c/d", overlaps: false},
+		{a: "+/a", b: "$SYS/+", overlaps: false},
+		{a: "$SYS/+/a", b: "$SYS/b/+", overlaps: true, join: "$SYS/+/+"},
+	} {
+		if actual := overlaps(test.a, test.b); actual != test.overlaps {
+			t.Errorf("overlaps(%q, %q) = %v, want %v", test.a, test.b, actual, test.overlaps)
+		}
+		if actual := overlaps(test.b, test.a); actual != test.overlaps {
+			t.Errorf("overlaps(%q, %q) = %v, want %v", test.b, test.a, actual, test.overlaps)
+		}
+		if !test.overlaps {
+			continue
+		}
+		if actual := join(test.a, test.b); actual != test.join {
+			t.Errorf("join(%q, %q) = %q, want %q", test.a, test.b, actual, test.join)
+		}
+	}
+}
+
+func TestMinimalFilters(t *testing.T) {
+	for _, test := range []struct {
+		filters []string
+		want    []string
+	}{
+		{filters: nil, want: nil},
+		{filters: []string{"/foo"}, want: []string{"/foo"}},
+		{filters: []string{"/foo", "/foo"}, want: []string{"/foo"}},
+		{
+			filters: []string{"/sensors/kitchen/temp", "/sensors/#", "/net/#", "/net/wlan/#"},
+			want:    []string{"/net/#", "/sensors/#"},
+		},
+		{
+			filters: []string{"zigbee2mqtt/bulb", "tele/+/SENSOR", "tele/sonoff/SENSOR", "/sensors/#"},
+			want:    []string{"/sensors/#", "tele/+/SENSOR", "zigbee2mqtt/bulb"},
+		},
+		{
+			filters: []string{"#", "/foo/bar", "$SYS/broker/uptime"},
+			want:    []string{"#", "$SYS/broker/uptime"},
+		},
+		{
+			// overlapping filters would deliver messages twice
+			filters: []string{"/a/+/c", "/a/b/#", "/a/b/d", "/x/y"},
+			want:    []string{"/a/+/#", "/x/y"},
+		},
+		{
+			filters: []string{"tele/+/SENSOR", "tele/sonoff/+", "tele/+/STATE", "stat/+/POWER"},
+			want:    []string{"stat/+/POWER", "tele/+/+"},
+		},
+	} {
+		actual := minimalFilters(test.filters)
+		if !reflect.DeepEqual(actual, test.want) {
+			t.Errorf("minimalFilters(%v) = %v, want %v", test.filters, actual, test.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -13,7 +14,7 @@ import (
 	"github.com/ktt-ol/mqlux/internal/mqlux"
 )
 
-func connect(conf config.MQTT, onConnect mqtt.OnConnectHandler) (mqtt.Client, error) {
+func connect(conf config.MQTT, onConnect mqtt.OnConnectHandler, onMessage mqtt.MessageHandler) (mqtt.Client, error) {
 	opts := mqtt.NewClientOptions()
 
 	opts.AddBroker(conf.URL)
@@ -51,6 +52,7 @@ func connect(conf config.MQTT, onConnect mqtt.OnConnectHandler) (mqtt.Client, er
 	opts.SetMaxReconnectInterval(5 * time.Minute)
 
 	opts.SetOnConnectHandler(onConnect)
+	opts.SetDefaultPublishHandler(onMessage)
 
 	mc := mqtt.NewClient(opts)
 	if tok := mc.Connect(); tok.WaitTimeout(10*time.Second) && tok.Error() != nil {
@@ -60,33 +62,101 @@ func connect(conf config.MQTT, onConnect mqtt.OnConnectHandler) (mqtt.Client, er
 	return mc, nil
 }
 
-type Disconnector interface {
-	Disconnect(waitms uint)
+// Conn is the connection to the MQTT server. The zero value is not
+// connected and can be passed to publishers before Subscribe connects.
+type Conn struct {
+	mu      sync.Mutex
+	client  mqtt.Client
+	filters []string
 }
 
-// Subscribe connects to the MQTT server and subscribes the handler function to /#.
-// Should only be called once for each client.
-func Subscribe(config config.MQTT, fwd func(mqlux.Message)) (Disconnector, error) {
-	c, err := connect(config, func(c mqtt.Client) {
+func (c *Conn) getClient() mqtt.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// Unsubscribe removes all subscriptions, so that no more messages are
+// received while the connection can still be used to publish messages.
+func (c *Conn) Unsubscribe() {
+	client := c.getClient()
+	if client == nil || len(c.filters) == 0 {
+		return
+	}
+	tok := client.Unsubscribe(c.filters...)
+	tok.WaitTimeout(10 * time.Second)
+	if err := tok.Error(); err != nil {
+		log.Print("error: unsubscribing: ", err)
+	}
+}
+
+// Disconnect closes the connection after waitms milliseconds.
+func (c *Conn) Disconnect(waitms uint) {
+	if client := c.getClient(); client != nil {
+		client.Disconnect(waitms)
+	}
+}
+
+// Publish publishes a message without waiting for the server. wait blocks
+// until the message is sent (QoS 0) or acknowledged (QoS 1 and 2).
+func (c *Conn) Publish(topic string, qos byte, retained bool, payload []byte) (wait func() error) {
+	client := c.getClient()
+	if client == nil {
+		return func() error { return errors.New("not connected to MQTT server") }
+	}
+	tok := client.Publish(topic, qos, retained, payload)
+	return func() error {
+		if !tok.WaitTimeout(10 * time.Second) {
+			return fmt.Errorf("publishing to %s: timeout", topic)
+		}
+		return tok.Error()
+	}
+}
+
+// Subscribe connects to the MQTT server and subscribes the handler function to
+// all topics. Topics are MQTT topic filters. Only the minimal set of filters is
+// subscribed (e.g. /foo/bar is not subscribed if /foo/# is also requested) and
+// the subscriptions are renewed after each reconnect.
+// Should only be called once for each Conn.
+func (c *Conn) Subscribe(config config.MQTT, topics []string, fwd func(mqlux.Message)) error {
+	filters := make(map[string]byte)
+	for _, t := range minimalFilters(topics) {
+		filters[t] = 0
+		c.filters = append(c.filters, t)
+	}
+	if len(filters) == 0 {
+		log.Print("warning: no topics to subscribe")
+	}
+
+	_, err := connect(config, func(client mqtt.Client) {
 		log.Print("debug: on connect")
-		// mqtt.Client only supports one callback for each topic and
-		// subscribing to a wildcard topic can overwrite callbacks
-		// to specific topics. We use our own router to work around
-		// this limitation.
-		tok := c.Subscribe("/#", 0, func(client mqtt.Client, message mqtt.Message) {
-			msg := mqlux.Message{
-				Time:     time.Now(),
-				Payload:  message.Payload(),
-				Topic:    message.Topic(),
-				Retained: message.Retained(),
-			}
-			fwd(msg)
-		})
+		// publishing is possible before the first message is forwarded
+		c.mu.Lock()
+		c.client = client
+		c.mu.Unlock()
+		if len(filters) == 0 {
+			return
+		}
+		for t := range filters {
+			log.Print("debug: subscribing to ", t)
+		}
+		// mqtt.Client only supports one callback for each topic and calls
+		// the callback of each matching subscription. We subscribe without
+		// callbacks so that all messages are forwarded once by the default
+		// handler and use our own router to dispatch them.
+		tok := client.SubscribeMultiple(filters, nil)
 		tok.WaitTimeout(30 * time.Second)
 		if err := tok.Error(); err != nil {
 			log.Print("error: on connect: ", err)
 		}
+	}, func(client mqtt.Client, message mqtt.Message) {
+		msg := mqlux.Message{
+			Time:     time.Now(),
+			Payload:  message.Payload(),
+			Topic:    message.Topic(),
+			Retained: message.Retained(),
+		}
+		fwd(msg)
 	})
-
-	return c, err
+	return err
 }
@@ -0,0 +1,244 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+// Publisher publishes MQTT messages.
+type Publisher interface {
+	// Publish starts to publish a single message. wait blocks until the
+	// message is sent.
+	Publish(topic string, qos byte, retained bool, payload []byte) (wait func() error)
+}
+
+// Republisher publishes records to MQTT. The topic is a template with
+// {measurement}, {field} and {tag} placeholders.
+type Republisher struct {
+	topic    string
+	hasField bool
+	json     bool
+	qos      byte
+	retain   bool
+
+	mu        sync.Mutex
+	publisher Publisher
+}
+
+var placeholder = regexp.MustCompile(`\{([^{}/]*)\}`)
+
+// NewRepublisher creates a new Republisher. Records can be written after
+// Connect.
+func NewRepublisher(conf config.Republish) (*Republisher, error) {
+	if conf.Topic == "" {
+		return nil, errors.New("missing topic")
+	}
+	literals := placeholder.ReplaceAllString(conf.Topic, "")
+	if strings.ContainsAny(literals, "{}") {
+		return nil, fmt.Errorf("invalid placeholder in topic %s", conf.Topic)
+	}
+	if strings.ContainsAny(literals, "+#") {
+		return nil, fmt.Errorf("wildcards are not allowed in topic %s", conf.Topic)
+	}
+	for _, m := range placeholder.FindAllStringSubmatch(conf.Topic, -1) {
+		if m[1] == "" {
+			return nil, fmt.Errorf("invalid placeholder in topic %s", conf.Topic)
+		}
+	}
+	if conf.QoS > 2 {
+		return nil, fmt.Errorf("invalid qos %d", conf.QoS)
+	}
+	r := &Republisher{
+		topic:    conf.Topic,
+		hasField: strings.Contains(conf.Topic, "{field}"),
+		qos:      conf.QoS,
+		retain:   conf.Retain,
+	}
+	switch conf.Format {
+	case "", "value":
+	case "json":
+		r.json = true
+	default:
+		return nil, fmt.Errorf("invalid format %s, expected value or json", conf.Format)
+	}
+	return r, nil
+}
+
+// Connect sets the connection for all following writes.
+func (r *Republisher) Connect(p Publisher) {
+	r.mu.Lock()
+	r.publisher = p
+	r.mu.Unlock()
+}
+
+// Write publishes all records and waits until all messages are sent. With the
+// json format, each record is published as a JSON object with measurement,
+// value, fields, tags and time. Otherwise, each field is published as plain
+// value. Fields other than value are published to <topic>/<field> if the
+// topic has no {field} placeholder.
+func (r *Republisher) Write(recs []mqlux.Record) error {
+	r.mu.Lock()
+	p := r.publisher
+	r.mu.Unlock()
+	if p == nil {
+		return errors.New("not connected to MQTT server")
+	}
+
+	var waits []func() error
+	publish := func(topic string, payload []byte) {
+		waits = append(waits, p.Publish(topic, r.qos, r.retain, payload))
+	}
+	for _, rec := range recs {
+		if r.json {
+			topic, err := r.expand(rec, "value")
+			if err != nil {
+				log.Printf("error: republishing %s: %s", rec.Measurement, err)
+				continue
+			}
+			payload, err := json.Marshal(jsonRecord(rec))
+			if err != nil {
+				log.Printf("error: republishing %s: %s", rec.Measurement, err)
+				continue
+			}
+			publish(topic, payload)
+			continue
+		}
+
+		fields := rec.FieldValues()
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			payload, ok := formatValue(fields[name])
+			if !ok {
+				continue
+			}
+			topic, err := r.expand(rec, name)
+			if err != nil {
+				log.Printf("error: republishing %s: %s", rec.Measurement, err)
+				continue
+			}
+			if !r.hasField && name != "value" {
+				if err := checkLevel(name, "field"); err != nil {
+					log.Printf("error: republishing %s: %s", rec.Measurement, err)
+					continue
+				}
+				topic += "/" + name
+			}
+			publish(topic, payload)
+		}
+	}
+
+	var firstErr error
+	for _, wait := range waits {
+		if err := wait(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Matches checks whether a message that is published by r can match filter
+// (e.g. if the records of a subscription with filter would be republished to
+// the same subscription). Placeholders expand to single topic levels, as
+// values with / are not published.
+func (r *Republisher) Matches(filter string) bool {
+	levels := strings.Split(r.topic, "/")
+	for i, l := range levels {
+		if placeholder.MatchString(l) {
+			levels[i] = "+"
+		}
+	}
+	topic := strings.Join(levels, "/")
+	if overlaps(topic, filter) {
+		return true
+	}
+	// other fields are published to <topic>/<field>
+	return !r.json && !r.hasField && overlaps(topic+"/+", filter)
+}
+
+// expand replaces all placeholders of the topic. Values must not contain
+// wildcards or /, so that each placeholder expands within its topic level.
+func (r *Republisher) expand(rec mqlux.Record, field string) (string, error) {
+	var err error
+	topic := placeholder.ReplaceAllStringFunc(r.topic, func(s string) string {
+		name := s[1 : len(s)-1]
+		var v string
+		switch name {
+		case "measurement":
+			v = rec.Measurement
+		case "field":
+			v = field
+		default:
+			var ok bool
+			if v, ok = rec.Tags[name]; !ok && err == nil {
+				err = fmt.Errorf("no tag for {%s}", name)
+			}
+		}
+		if lerr := checkLevel(v, name); lerr != nil && err == nil {
+			err = lerr
+		}
+		return v
+	})
+	return topic, err
+}
+
+// checkLevel checks that v (the value for {name}) does not contain wildcards
+// or additional topic levels.
+func checkLevel(v, name string) error {
+	if strings.ContainsAny(v, "+#") {
+		return fmt.Errorf("wildcard in value %q for {%s}", v, name)
+	}
+	if strings.Contains(v, "/") {
+		return fmt.Errorf("topic level separator in value %q for {%s}", v, name)
+	}
+	return nil
+}
+
+// formatValue formats a field value as plain MQTT payload.
+func formatValue(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), true
+	case string:
+		return []byte(v), true
+	case nil:
+		return nil, false
+	}
+	return []byte(fmt.Sprint(v)), true
+}
+
+type republishRecord struct {
+	Measurement string                 `json:"measurement"`
+	Value       interface{}            `json:"value,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Time        string                 `json:"time"`
+}
+
+func jsonRecord(rec mqlux.Record) republishRecord {
+	t := rec.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return republishRecord{
+		Measurement: rec.Measurement,
+		Value:       rec.Value,
+		Fields:      rec.Fields,
+		Tags:        rec.Tags,
+		Time:        t.Format(time.RFC3339Nano),
+	}
+}
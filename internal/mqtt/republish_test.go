@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+type message struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  string
+}
+
+type fakePublisher struct {
+	msgs []message
+}
+
+func (p *fakePublisher) Publish(topic string, qos byte, retained bool, payload []byte) func() error {
+	p.msgs = append(p.msgs, message{topic, qos, retained, string(payload)})
+	return func() error { return nil }
+}
+
+func TestRepublish(t *testing.T) {
+	ts := time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		Conf    config.Republish
+		Records []mqlux.Record
+		Want    []message
+	}{
+		{
+			Conf:    config.Republish{Topic: "normalized/{measurement}", QoS: 1, Retain: true},
+			Records: []mqlux.Record{{Measurement: "people", Value: 42.0}},
+			Want:    []message{{"normalized/people", 1, true, "42"}},
+		},
+		{
+			Conf: config.Republish{Topic: "normalized/{room}/{measurement}"},
+			Records: []mqlux.Record{
+				{Measurement: "climate", Tags: map[string]string{"room": "kitchen"}, Value: 21.5, Fields: map[string]interface{}{"humidity": 40, "ok": true}},
+				{Measurement: "climate", Value: 1.0},
+				{Measurement: "climate", Tags: map[string]string{"room": "#"}, Value: 1.0},
+				// values with / would publish to other topic levels
+				{Measurement: "climate", Tags: map[string]string{"room": "kitchen/oven"}, Value: 1.0},
+				{Measurement: "climate", Tags: map[string]string{"room": "hall"}, Fields: map[string]interface{}{"a/b": 1.0}},
+			},
+			Want: []message{
+				{"normalized/kitchen/climate/humidity", 0, false, "40"},
+				{"normalized/kitchen/climate/ok", 0, false, "true"},
+				{"normalized/kitchen/climate", 0, false, "21.5"},
+			},
+		},
+		{
+			Conf:    config.Republish{Topic: "normalized/{field}"},
+			Records: []mqlux.Record{{Measurement: "status", Fields: map[string]interface{}{"message": "open", "none": nil}}},
+			Want:    []message{{"normalized/message", 0, false, "open"}},
+		},
+		{
+			Conf:    config.Republish{Topic: "normalized/{measurement}", Format: "json"},
+			Records: []mqlux.Record{{Measurement: "people", Tags: map[string]string{"room": "space"}, Value: 42.0, Time: ts}},
+			Want:    []message{{"normalized/people", 0, false, `{"measurement":"people","value":42,"tags":{"room":"space"},"time":"2018-02-01T12:00:00Z"}`}},
+		},
+	} {
+		r, err := NewRepublisher(test.Conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &fakePublisher{}
+		r.Connect(p)
+		if err := r.Write(test.Records); err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(p.msgs, test.Want) {
+			t.Errorf("unexpected messages for %s\n%v\n!=\n%v", test.Conf.Topic, p.msgs, test.Want)
+		}
+	}
+}
+
+func TestRepublishErrors(t *testing.T) {
+	for _, conf := range []config.Republish{
+		{},
+		{Topic: "normalized/#"},
+		{Topic: "normalized/+/{measurement}"},
+		{Topic: "normalized/{}"},
+		{Topic: "normalized/{measurement"},
+		{Topic: "normalized", QoS: 3},
+		{Topic: "normalized", Format: "xml"},
+	} {
+		if _, err := NewRepublisher(conf); err == nil {
+			t.Errorf("expected error for %v", conf)
+		}
+	}
+
+	r, err := NewRepublisher(config.Republish{Topic: "normalized"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Write([]mqlux.Record{{Measurement: "people", Value: 42.0}}); err == nil {
+		t.Error("expected error without connection")
+	}
+}
+
+func TestRepublishMatches(t *testing.T) {
+	for _, test := range []struct {
+		Conf    config.Republish
+		Filter  string
+		Matches bool
+	}{
+		{Conf: config.Republish{Topic: "normalized/{measurement}"}, Filter: "normalized/#", Matches: true},
+		{Conf: config.Republish{Topic: "normalized/{measurement}"}, Filter: "normalized/people", Matches: true},
+		{Conf: config.Republish{Topic: "normalized/{measurement}"}, Filter: "sensors/#", Matches: false},
+		{Conf: config.Republish{Topic: "normalized/{measurement}"}, Filter: "#", Matches: true},
+		// other fields are published to normalized/<measurement>/<field>
+		{Conf: config.Republish{Topic: "normalized/{measurement}"}, Filter: "+/+/humidity", Matches: true},
+		{Conf: config.Republish{Topic: "normalized/{measurement}", Format: "json"}, Filter: "+/+/humidity", Matches: false},
+		{Conf: config.Republish{Topic: "normalized/{room}-{field}"}, Filter: "normalized/kitchen-temp", Matches: true},
+		{Conf: config.Republish{Topic: "normalized/{room}-{field}"}, Filter: "normalized/+/temp", Matches: false},
+		// placeholders never expand to multiple levels
+		{Conf: config.Republish{Topic: "normalized/{room}", Format: "json"}, Filter: "normalized/+/+", Matches: false},
+	} {
+		r, err := NewRepublisher(test.Conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := r.Matches(test.Filter); actual != test.Matches {
+			t.Errorf("Matches(%q) for %s = %v, want %v", test.Filter, test.Conf.Topic, actual, test.Matches)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Package opentsdb sends records to OpenTSDB, either with the telnet style
+// put command over TCP or as JSON to the HTTP API (/api/put).
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/retry"
+	"github.com/ktt-ol/mqlux/internal/socket"
+)
+
+// stats exports the number of written data points and errors as opentsdb in
+// /debug/vars.
+var stats = expvar.NewMap("opentsdb")
+
+// maxPutPoints limits the number of data points of each HTTP request.
+const maxPutPoints = 50
+
+// DataPoint is a single OpenTSDB data point as sent to /api/put.
+type DataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// Writer sends records to OpenTSDB.
+type Writer struct {
+	prefix string
+
+	// conn is set for the put command
+	conn *socket.TCPConn
+
+	// url is set for the HTTP API
+	url        string
+	httpClient *http.Client
+	backoff    retry.Backoff
+}
+
+// New creates a new Writer for the address or the URL of conf. The
+// connection is established with the first write.
+func New(conf config.OpenTSDB) (*Writer, error) {
+	w := &Writer{prefix: conf.Prefix}
+	switch {
+	case conf.Address != "" && conf.URL != "":
+		return nil, errors.New("expected either address or url")
+	case conf.Address != "":
+		conn, err := socket.NewTCPConn(conf.Address)
+		if err != nil {
+			return nil, err
+		}
+		w.conn = conn
+	case conf.URL != "":
+		u, err := url.Parse(conf.URL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, errors.New("opentsdb url requires http or https scheme")
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/api/put"
+		}
+		w.url = u.String()
+		w.httpClient = &http.Client{Timeout: 30 * time.Second}
+		w.backoff = retry.DefaultBackoff(retry.Attempts(conf.Retries))
+	default:
+		return nil, errors.New("missing address or url")
+	}
+	return w, nil
+}
+
+// Write sends all numeric fields of the records as data points.
+// Non-numeric fields are skipped.
+func (w *Writer) Write(recs []mqlux.Record) error {
+	var points []DataPoint
+	for _, rec := range recs {
+		points = append(points, DataPoints(w.prefix, rec)...)
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	var err error
+	if w.conn != nil {
+		err = w.put(points)
+	} else {
+		err = w.postAll(points)
+	}
+	if err != nil {
+		stats.Add("errors", 1)
+		return err
+	}
+	stats.Add("points_written", int64(len(points)))
+	return nil
+}
+
+// Stop closes the connection of the put command.
+func (w *Writer) Stop() {
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// put sends the data points with the put command.
+func (w *Writer) put(points []DataPoint) error {
+	var buf []byte
+	for _, p := range points {
+		buf = append(buf, "put "...)
+		buf = append(buf, p.Metric...)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, p.Timestamp, 10)
+		buf = append(buf, ' ')
+		buf = strconv.AppendFloat(buf, p.Value, 'f', -1, 64)
+		keys := make([]string, 0, len(p.Tags))
+		for k := range p.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf = append(buf, ' ')
+			buf = append(buf, k...)
+			buf = append(buf, '=')
+			buf = append(buf, p.Tags[k]...)
+		}
+		buf = append(buf, '\n')
+	}
+	return w.conn.Send(buf)
+}
+
+// postAll sends the data points in chunks of maxPutPoints to the HTTP API.
+func (w *Writer) postAll(points []DataPoint) error {
+	for len(points) > 0 {
+		n := len(points)
+		if n > maxPutPoints {
+			n = maxPutPoints
+		}
+		body, err := json.Marshal(points[:n])
+		if err != nil {
+			return err
+		}
+		err = w.backoff.Do(func() error {
+			return w.post(body)
+		}, func(err error, delay time.Duration) {
+			stats.Add("retries", 1)
+			log.Printf("warning: opentsdb write of %d points, retrying in %s: %s", n, delay, err)
+		})
+		if err != nil {
+			return err
+		}
+		points = points[n:]
+	}
+	return nil
+}
+
+func (w *Writer) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mqlux")
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return retry.StatusError(resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// DataPoints returns a data point for each numeric field of rec. The metric
+// is prefix + measurement, with .field appended for fields other than value.
+// OpenTSDB requires at least one tag, records without tags are sent with
+// source=mqlux. Timestamps are in milliseconds.
+func DataPoints(prefix string, rec mqlux.Record) []DataPoint {
+	t := rec.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	ts := t.UnixNano() / int64(time.Millisecond)
+
+	tags := make(map[string]string, len(rec.Tags))
+	for k, v := range rec.Tags {
+		if k == "" || v == "" {
+			continue
+		}
+		tags[sanitize(k)] = sanitize(v)
+	}
+	if len(tags) == 0 {
+		tags["source"] = "mqlux"
+	}
+
+	fields := rec.FieldValues()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var points []DataPoint
+	for _, name := range names {
+		v, ok := mqlux.Float(fields[name])
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			if fields[name] != nil {
+				stats.Add("points_dropped", 1)
+			}
+			continue
+		}
+		metric := prefix + rec.Measurement
+		if name != "value" {
+			metric += "." + name
+		}
+		points = append(points, DataPoint{
+			Metric:    sanitize(metric),
+			Timestamp: ts,
+			Value:     v,
+			Tags:      tags,
+		})
+	}
+	return points
+}
+
+// sanitize replaces all characters that are not allowed in OpenTSDB metric
+// names and tags with _. Allowed are letters, digits, -, _, . and /.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '/':
+			return r
+		}
+		return '_'
+	}, s)
+}
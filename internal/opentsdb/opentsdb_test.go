@@ -0,0 +1,131 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/socket/sockettest"
+)
+
+var ts = time.Unix(1517486400, 123000000)
+
+func TestDataPoints(t *testing.T) {
+	for _, test := range []struct {
+		Record mqlux.Record
+		Want   []DataPoint
+	}{
+		{
+			Record: mqlux.Record{Measurement: "temperature", Value: 21.5, Time: ts},
+			Want:   []DataPoint{{"mqlux.temperature", 1517486400123, 21.5, map[string]string{"source": "mqlux"}}},
+		},
+		{
+			Record: mqlux.Record{
+				Measurement: "power meter",
+				Tags:        map[string]string{"room name": "living room", "empty": ""},
+				Fields:      map[string]interface{}{"total": int64(42), "on": false, "status": "ok", "none": nil},
+				Time:        ts,
+			},
+			Want: []DataPoint{
+				{"mqlux.power_meter.on", 1517486400123, 0, map[string]string{"room_name": "living_room"}},
+				{"mqlux.power_meter.total", 1517486400123, 42, map[string]string{"room_name": "living_room"}},
+			},
+		},
+	} {
+		if actual := DataPoints("mqlux.", test.Record); !reflect.DeepEqual(actual, test.Want) {
+			t.Errorf("unexpected data points\n%v\n!=\n%v", actual, test.Want)
+		}
+	}
+}
+
+func TestPut(t *testing.T) {
+	s := sockettest.NewServer()
+	defer s.Close()
+
+	w, err := New(config.OpenTSDB{Address: s.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	want := []string{
+		"put temperature 1517486400123 0 room=room-0",
+		"put temperature 1517486400123 1 room=room-1",
+		"put temperature 1517486400123 2 room=room-2",
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.Write(sockettest.Records(3, ts)); err != nil {
+			t.Fatal(err)
+		}
+		s.Expect(t, want...)
+		// next write uses a new connection
+		w.Stop()
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var requests [][]DataPoint
+	fail := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/put" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if fail > 0 {
+			fail--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var points []DataPoint
+		if err := json.NewDecoder(r.Body).Decode(&points); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, points)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := New(config.OpenTSDB{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backoff.Min = time.Millisecond
+	if err := w.Write(sockettest.Records(maxPutPoints+1, ts)); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || len(requests[0]) != maxPutPoints || len(requests[1]) != 1 {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+	want := DataPoint{"temperature", 1517486400123, 50, map[string]string{"room": "room-50"}}
+	if !reflect.DeepEqual(requests[1][0], want) {
+		t.Errorf("unexpected data point %v != %v", requests[1][0], want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, conf := range []config.OpenTSDB{
+		{},
+		{Address: "localhost:4242", URL: "http://localhost:4242"},
+		{Address: "localhost"},
+		{URL: "localhost:4242"},
+	} {
+		if _, err := New(conf); err == nil {
+			t.Errorf("expected error for %v", conf)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"code":400,"message":"invalid tag"}}`, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	w, err := New(config.OpenTSDB{URL: srv.URL + "/api/put?details"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(sockettest.Records(1, ts)); err == nil {
+		t.Error("expected error for bad request")
+	}
+}
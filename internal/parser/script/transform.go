@@ -2,6 +2,7 @@ package script
 
 import (
 	"sync"
+	"time"
 
 	"github.com/ktt-ol/mqlux/internal/mqlux"
 	"github.com/pkg/errors"
@@ -96,6 +97,26 @@ func valueToStringMap(v otto.Value) (map[string]string, error) {
 	}
 	return tags, nil
 }
+
+func valueToValueMap(v otto.Value) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if !v.IsObject() {
+		return nil, errors.New("not an object")
+	}
+	obj := v.Object()
+	for _, k := range obj.Keys() {
+		vv, err := obj.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		fields[k], err = valueToValue(vv)
+		if err != nil {
+			return nil, errors.Wrapf(err, "field %s", k)
+		}
+	}
+	return fields, nil
+}
+
 func valueToValue(v otto.Value) (interface{}, error) {
 	var result interface{}
 	var err error
@@ -122,6 +143,29 @@ func valueToValue(v otto.Value) (interface{}, error) {
 	return result, nil
 }
 
+// valueToTime converts a Date object, a number (milliseconds since epoch
+// like Date.now()) or a RFC3339 string to time.Time.
+func valueToTime(v otto.Value) (time.Time, error) {
+	if v.IsObject() && v.Class() == "Date" {
+		var err error
+		v, err = v.Object().Call("getTime")
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	if v.IsNumber() {
+		ms, err := v.ToInteger()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	if v.IsString() {
+		return time.Parse(time.RFC3339Nano, v.String())
+	}
+	return time.Time{}, errors.Errorf("unsupported time of class: %s", v.Class())
+}
+
 func objectToRecord(v otto.Value) (*mqlux.Record, error) {
 	rec := mqlux.Record{}
 	if !v.IsObject() {
@@ -142,14 +186,38 @@ func objectToRecord(v otto.Value) (*mqlux.Record, error) {
 		}
 	}
 
-	// value
+	// fields
+	v, err = o.Get("fields")
+	if err != nil {
+		return nil, err
+	}
+	if !v.IsUndefined() {
+		if rec.Fields, err = valueToValueMap(v); err != nil {
+			return nil, errors.Wrap(err, "extracting fields")
+		}
+	}
+
+	// value, optional if fields are set
 	v, err = o.Get("value")
 	if err != nil {
 		return nil, err
 	}
-	if rec.Value, err = valueToValue(v); err != nil {
+	if !v.IsUndefined() || len(rec.Fields) == 0 {
+		if rec.Value, err = valueToValue(v); err != nil {
+			return nil, err
+		}
+	}
+
+	// time
+	v, err = o.Get("time")
+	if err != nil {
 		return nil, err
 	}
+	if !v.IsUndefined() {
+		if rec.Time, err = valueToTime(v); err != nil {
+			return nil, errors.Wrap(err, "extracting time")
+		}
+	}
 
 	// tags
 	v, err = o.Get("tags")
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ktt-ol/mqlux/internal/mqlux"
 	"github.com/robertkrimen/otto"
@@ -47,6 +48,34 @@ func TestValueToRecords(t *testing.T) {
 				{Measurement: "temperature", Value: 99.0,
 					Tags: map[string]string{"room": "kitchen", "height": "1.5"}}},
 		},
+		{
+			JS: `_ = {measurement: "climate", fields: {"temperature": 21.5, "humidity": 40, "ok": true}}`,
+			Want: []mqlux.Record{
+				{Measurement: "climate",
+					Fields: map[string]interface{}{"temperature": 21.5, "humidity": 40.0, "ok": true}}},
+		},
+		{
+			JS: `_ = {measurement: "climate", value: 1, fields: {"temperature": 21.5}}`,
+			Want: []mqlux.Record{
+				{Measurement: "climate", Value: 1.0,
+					Fields: map[string]interface{}{"temperature": 21.5}}},
+		},
+		{
+			JS:    `_ = {measurement: "climate", fields: {"temperature": undefined}}`,
+			Error: "field temperature",
+		},
+		{
+			JS: `[{value: 1, time: 1517486400000}, {value: 2, time: "2018-02-01T12:00:00Z"}, {value: 3, time: new Date(1517486400000)}]`,
+			Want: []mqlux.Record{
+				{Value: 1.0, Time: time.Unix(1517486400, 0)},
+				{Value: 2.0, Time: time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)},
+				{Value: 3.0, Time: time.Unix(1517486400, 0)},
+			},
+		},
+		{
+			JS:    `_ = {value: 1, time: "yesterday"}`,
+			Error: "extracting time",
+		},
 		{
 			JS:   `[]`,
 			Want: nil,
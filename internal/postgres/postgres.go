@@ -0,0 +1,227 @@
+// Package postgres writes records to a PostgreSQL or TimescaleDB table.
+//
+// Each numeric field of a record is stored as one row with the columns
+// time, measurement, field, value and tags. Tags are stored as JSONB, or in
+// dedicated text columns if they are configured as tag_columns.
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/lib/pq"
+)
+
+// stats exports the number of written rows and errors as postgres in
+// /debug/vars.
+var stats = expvar.NewMap("postgres")
+
+// DefaultTable is the table name if none is configured.
+const DefaultTable = "mqlux"
+
+// Writer writes records to a PostgreSQL table.
+type Writer struct {
+	db         *sql.DB
+	schema     string
+	table      string
+	tagColumns []string
+}
+
+// New connects to the database of conf and creates the table (and the
+// TimescaleDB hypertable) if it does not exist.
+func New(conf config.Postgres) (*Writer, error) {
+	if conf.URL == "" {
+		return nil, errors.New("missing url")
+	}
+	table := conf.Table
+	if table == "" {
+		table = DefaultTable
+	}
+	w := &Writer{table: table}
+	if i := strings.IndexByte(table, '.'); i >= 0 {
+		w.schema, w.table = table[:i], table[i+1:]
+	}
+	for _, c := range conf.TagColumns {
+		switch c {
+		case "time", "measurement", "field", "value", "tags":
+			return nil, fmt.Errorf("tag column %s conflicts with default column", c)
+		}
+		w.tagColumns = append(w.tagColumns, c)
+	}
+
+	db, err := sql.Open("postgres", conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	w.db = db
+	if err := w.createTable(conf.Hypertable); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// qualifiedTable returns the quoted (schema and) table name.
+func (w *Writer) qualifiedTable() string {
+	if w.schema != "" {
+		return pq.QuoteIdentifier(w.schema) + "." + pq.QuoteIdentifier(w.table)
+	}
+	return pq.QuoteIdentifier(w.table)
+}
+
+// columns returns the names of all columns in the order of Rows.
+func (w *Writer) columns() []string {
+	return append([]string{"time", "measurement", "field", "value", "tags"}, w.tagColumns...)
+}
+
+// createStatements returns the statements to create the table and indices.
+func (w *Writer) createStatements(hypertable bool) []string {
+	cols := []string{
+		"time TIMESTAMPTZ NOT NULL",
+		"measurement TEXT NOT NULL",
+		"field TEXT NOT NULL",
+		"value DOUBLE PRECISION",
+		"tags JSONB",
+	}
+	for _, c := range w.tagColumns {
+		cols = append(cols, pq.QuoteIdentifier(c)+" TEXT")
+	}
+	table := w.qualifiedTable()
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)", table, strings.Join(cols, ",\n\t")),
+	}
+	if hypertable {
+		stmts = append(stmts, fmt.Sprintf("SELECT create_hypertable(%s, 'time', if_not_exists => TRUE)",
+			pq.QuoteLiteral(table)))
+	}
+	stmts = append(stmts, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (measurement, field, time DESC)",
+		pq.QuoteIdentifier(w.table+"_measurement_field_time_idx"), table))
+	return stmts
+}
+
+func (w *Writer) createTable(hypertable bool) error {
+	log.Printf("debug: creating table %s", w.qualifiedTable())
+	for _, stmt := range w.createStatements(hypertable) {
+		if _, err := w.db.Exec(stmt); err != nil {
+			return fmt.Errorf("creating table %s: %s", w.qualifiedTable(), err)
+		}
+	}
+	return nil
+}
+
+// Write inserts all numeric fields of the records with a single COPY.
+// Non-numeric fields are skipped.
+func (w *Writer) Write(recs []mqlux.Record) error {
+	var rows [][]interface{}
+	for _, rec := range recs {
+		rows = append(rows, w.Rows(rec)...)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := w.copy(rows); err != nil {
+		stats.Add("errors", 1)
+		return err
+	}
+	stats.Add("rows_written", int64(len(rows)))
+	return nil
+}
+
+func (w *Writer) copy(rows [][]interface{}) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyInSchema(w.schema, w.table, w.columns()...))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Stop closes the database connections.
+func (w *Writer) Stop() {
+	w.db.Close()
+}
+
+// Rows returns a row for each numeric field of rec. Booleans are stored as
+// 0 and 1. Tags without a dedicated column are stored as JSON object in the
+// tags column (NULL if there are none).
+func (w *Writer) Rows(rec mqlux.Record) [][]interface{} {
+	t := rec.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	tagValues := make([]interface{}, len(w.tagColumns))
+	other := make(map[string]string)
+	for k, v := range rec.Tags {
+		if k == "" || v == "" {
+			continue
+		}
+		other[k] = v
+	}
+	for i, c := range w.tagColumns {
+		if v, ok := other[c]; ok {
+			tagValues[i] = v
+			delete(other, c)
+		}
+	}
+	var tags interface{}
+	if len(other) > 0 {
+		b, err := json.Marshal(other)
+		if err != nil {
+			log.Printf("error: encoding tags of %s: %s", rec.Measurement, err)
+		} else {
+			tags = string(b)
+		}
+	}
+
+	fields := rec.FieldValues()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rows [][]interface{}
+	for _, name := range names {
+		v, ok := mqlux.Float(fields[name])
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			if fields[name] != nil {
+				stats.Add("rows_dropped", 1)
+			}
+			continue
+		}
+		row := []interface{}{t, rec.Measurement, name, v, tags}
+		rows = append(rows, append(row, tagValues...))
+	}
+	return rows
+}
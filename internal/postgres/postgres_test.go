@@ -0,0 +1,118 @@
+package postgres
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+func TestRows(t *testing.T) {
+	ts := time.Unix(1517486400, 0)
+	w := &Writer{table: "mqlux", tagColumns: []string{"room"}}
+	for _, test := range []struct {
+		Record mqlux.Record
+		Want   [][]interface{}
+	}{
+		{
+			Record: mqlux.Record{Measurement: "temperature", Tags: map[string]string{"room": "kitchen"}, Value: 21.5, Time: ts},
+			Want:   [][]interface{}{{ts, "temperature", "value", 21.5, nil, "kitchen"}},
+		},
+		{
+			Record: mqlux.Record{
+				Measurement: "climate",
+				Tags:        map[string]string{"sensor": "dht22", "floor": "1", "empty": ""},
+				Value:       21.5,
+				Fields:      map[string]interface{}{"humidity": 40, "open": true, "status": "ok"},
+				Time:        ts,
+			},
+			Want: [][]interface{}{
+				{ts, "climate", "humidity", 40.0, `{"floor":"1","sensor":"dht22"}`, nil},
+				{ts, "climate", "open", 1.0, `{"floor":"1","sensor":"dht22"}`, nil},
+				{ts, "climate", "value", 21.5, `{"floor":"1","sensor":"dht22"}`, nil},
+			},
+		},
+		{
+			Record: mqlux.Record{Measurement: "status", Value: "ok", Time: ts},
+		},
+	} {
+		if actual := w.Rows(test.Record); !reflect.DeepEqual(actual, test.Want) {
+			t.Errorf("unexpected rows for %v\n%v\n!=\n%v", test.Record, actual, test.Want)
+		}
+	}
+}
+
+func TestCreateStatements(t *testing.T) {
+	w := &Writer{schema: "sensors", table: "data", tagColumns: []string{"room"}}
+	stmts := w.createStatements(true)
+	if len(stmts) != 3 {
+		t.Fatalf("unexpected statements %v", stmts)
+	}
+	if !strings.HasPrefix(stmts[0], `CREATE TABLE IF NOT EXISTS "sensors"."data" (`) || !strings.Contains(stmts[0], `"room" TEXT`) {
+		t.Errorf("unexpected create table statement %s", stmts[0])
+	}
+	if want := `SELECT create_hypertable('"sensors"."data"', 'time', if_not_exists => TRUE)`; stmts[1] != want {
+		t.Errorf("unexpected hypertable statement %s != %s", stmts[1], want)
+	}
+	if len(w.createStatements(false)) != 2 {
+		t.Error("unexpected hypertable statement")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, conf := range []config.Postgres{
+		{},
+		{URL: "postgres://localhost/mqlux", TagColumns: []string{"value"}},
+	} {
+		if _, err := New(conf); err == nil {
+			t.Errorf("expected error for %v", conf)
+		}
+	}
+}
+
+// TestPostgres writes to a real database. Set MQLUX_TEST_POSTGRES to a
+// connection string (e.g. postgres://mqlux@localhost/mqlux?sslmode=disable)
+// to run this test.
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("MQLUX_TEST_POSTGRES")
+	if url == "" {
+		t.Skip("MQLUX_TEST_POSTGRES not set")
+	}
+	table := fmt.Sprintf("mqlux_test_%d", time.Now().UnixNano())
+	w, err := New(config.Postgres{URL: url, Table: table, TagColumns: []string{"room"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	defer w.db.Exec("DROP TABLE " + w.qualifiedTable())
+
+	ts := time.Unix(1517486400, 0)
+	var recs []mqlux.Record
+	for i := 0; i < 10; i++ {
+		recs = append(recs, mqlux.Record{
+			Measurement: "temperature",
+			Tags:        map[string]string{"room": fmt.Sprintf("room-%d", i), "sensor": "dht22"},
+			Value:       float64(i),
+			Time:        ts,
+		})
+	}
+	if err := w.Write(recs); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	var sum float64
+	err = w.db.QueryRow("SELECT count(*), sum(value) FROM "+w.qualifiedTable()+
+		" WHERE measurement = 'temperature' AND tags->>'sensor' = 'dht22' AND room LIKE 'room-%'").Scan(&count, &sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 || sum != 45 {
+		t.Errorf("unexpected count %d and sum %f", count, sum)
+	}
+}
@@ -0,0 +1,271 @@
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+// Exporter keeps the latest value of each series (measurement, field and
+// tags) and exports them as gauges in the Prometheus text format.
+type Exporter struct {
+	prefix string
+	expiry time.Duration
+
+	mu     sync.Mutex
+	series map[string]*series
+	// expired is the time of the last removal of expired series
+	expired time.Time
+	now     func() time.Time
+}
+
+type series struct {
+	name    string
+	labels  []label
+	value   float64
+	updated time.Time
+}
+
+type label struct {
+	name, value string
+}
+
+// New creates a new Exporter. All metric names are prefixed with prefix.
+// Series without updates for longer than expiry are removed (0 for no
+// expiry).
+func New(prefix string, expiry time.Duration) *Exporter {
+	return &Exporter{
+		prefix: prefix,
+		expiry: expiry,
+		series: make(map[string]*series),
+		now:    time.Now,
+	}
+}
+
+// Write updates the latest values. The value field is exported as
+// <measurement>, other fields as <measurement>_<field>. Records with
+// non-numeric values (strings) are ignored. Expired series are removed once
+// per expiry, also if /metrics is not scraped.
+func (e *Exporter) Write(recs []mqlux.Record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.now()
+	if e.expiry > 0 && now.Sub(e.expired) > e.expiry {
+		e.expire(now)
+	}
+	for _, rec := range recs {
+		for _, smp := range samples(e.prefix, rec) {
+			key := seriesKey(smp.name, smp.labels)
+			s, ok := e.series[key]
+			if !ok {
+				s = &series{name: smp.name, labels: smp.labels}
+				e.series[key] = s
+			}
+			s.value = smp.value
+			s.updated = now
+		}
+	}
+	return nil
+}
+
+// sample is a single value of a record.
+type sample struct {
+	name   string
+	labels []label
+	value  float64
+}
+
+// samples returns a sample for each numeric field of the record. The value
+// field is named <prefix><measurement>, other fields
+// <prefix><measurement>_<field>. The labels are sorted by name.
+func samples(prefix string, rec mqlux.Record) []sample {
+	labels := tagLabels(rec.Tags)
+
+	var result []sample
+	for field, v := range rec.FieldValues() {
+		value, ok := mqlux.Float(v)
+		if !ok {
+			continue
+		}
+		name := prefix + rec.Measurement
+		if field != "value" {
+			name += "_" + field
+		}
+		result = append(result, sample{name: MetricName(name), labels: labels, value: value})
+	}
+	return result
+}
+
+// tagLabels returns the tags as labels sorted by name. Tags with empty values
+// are skipped, as Prometheus does not distinguish them from missing labels.
+// If multiple tags have the same label name (e.g. room-name and room_name),
+// the tag with a valid name is used, or the first tag in sort order.
+func tagLabels(tags map[string]string) []label {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	names := make(map[string]string, len(keys))
+	for _, k := range keys {
+		if name := LabelName(k); name == k {
+			names[name] = k
+		}
+	}
+	for _, k := range keys {
+		if name := LabelName(k); names[name] == "" {
+			names[name] = k
+		}
+	}
+
+	labels := make([]label, 0, len(names))
+	for name, k := range names {
+		labels = append(labels, label{name: name, value: tags[k]})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// ServeHTTP writes all current values in the Prometheus text format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	lastName := ""
+	for _, s := range e.current() {
+		if s.name != lastName {
+			fmt.Fprintf(bw, "# TYPE %s gauge\n", s.name)
+			lastName = s.name
+		}
+		writeSeries(bw, s)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Println("debug: writing metrics", err)
+	}
+}
+
+// current removes all expired series and returns a sorted copy of all other
+// series.
+func (e *Exporter) current() []series {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.expiry > 0 {
+		e.expire(e.now())
+	}
+	result := make([]series, 0, len(e.series))
+	for _, s := range e.series {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].name != result[j].name {
+			return result[i].name < result[j].name
+		}
+		return seriesKey("", result[i].labels) < seriesKey("", result[j].labels)
+	})
+	return result
+}
+
+// expire removes all series without updates for longer than expiry.
+func (e *Exporter) expire(now time.Time) {
+	for key, s := range e.series {
+		if now.Sub(s.updated) > e.expiry {
+			delete(e.series, key)
+		}
+	}
+	e.expired = now
+}
+
+func writeSeries(w *bufio.Writer, s series) {
+	w.WriteString(s.name)
+	if len(s.labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range s.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l.name)
+			w.WriteString(`="`)
+			w.WriteString(labelValueEscaper.Replace(l.value))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(s.value))
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func seriesKey(name string, labels []label) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range labels {
+		b.WriteByte(0)
+		b.WriteString(l.name)
+		b.WriteByte(0)
+		b.WriteString(l.value)
+	}
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// MetricName converts name into a valid Prometheus metric name by replacing
+// all invalid characters with _.
+func MetricName(name string) string {
+	return sanitize(name, true)
+}
+
+// LabelName converts name into a valid Prometheus label name by replacing
+// all invalid characters with _. Label names starting with __ are reserved
+// and get an additional prefix.
+func LabelName(name string) string {
+	name = sanitize(name, false)
+	if strings.HasPrefix(name, "__") {
+		name = "tag" + name
+	}
+	return name
+}
+
+func sanitize(name string, allowColon bool) string {
+	var b strings.Builder
+	for i, c := range []byte(name) {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == ':' && allowColon:
+			b.WriteByte(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
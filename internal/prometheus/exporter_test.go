@@ -0,0 +1,125 @@
+package prometheus
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+func TestNames(t *testing.T) {
+	for name, want := range map[string]string{
+		"temperature":     "temperature",
+		"tx-bytes":        "tx_bytes",
+		"1wire.temp":      "_1wire_temp",
+		"node:cpu":        "node:cpu",
+		"temperature °C":  "temperature___C",
+		"":                "_",
+		"sensor/humidity": "sensor_humidity",
+	} {
+		if actual := MetricName(name); actual != want {
+			t.Errorf("MetricName(%q) = %q, want %q", name, actual, want)
+		}
+	}
+	for name, want := range map[string]string{
+		"room":      "room",
+		"node:cpu":  "node_cpu",
+		"__name__":  "tag__name__",
+		"1st-floor": "_1st_floor",
+	} {
+		if actual := LabelName(name); actual != want {
+			t.Errorf("LabelName(%q) = %q, want %q", name, actual, want)
+		}
+	}
+}
+
+func TestTagLabels(t *testing.T) {
+	for _, test := range []struct {
+		tags map[string]string
+		want []label
+	}{
+		{tags: nil, want: []label{}},
+		{
+			tags: map[string]string{"room": "kitchen", "sensor": "", "": "x"},
+			want: []label{{"room", "kitchen"}},
+		},
+		{
+			tags: map[string]string{"room-name": "kitchen", "room_name": "living room", "type": "dht22"},
+			want: []label{{"room_name", "living room"}, {"type", "dht22"}},
+		},
+		{
+			tags: map[string]string{"room-name": "kitchen", "room.name": "living room"},
+			want: []label{{"room_name", "kitchen"}},
+		},
+	} {
+		if actual := tagLabels(test.tags); !reflect.DeepEqual(actual, test.want) {
+			t.Errorf("tagLabels(%v) = %v, want %v", test.tags, actual, test.want)
+		}
+	}
+}
+
+func TestExporter(t *testing.T) {
+	now := time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)
+	e := New("mqlux_", 5*time.Minute)
+	e.now = func() time.Time { return now }
+
+	e.Write([]mqlux.Record{
+		{Measurement: "temperature", Tags: map[string]string{"room": "kitchen", "sensor-type": "dht22"}, Value: 21.5},
+		{Measurement: "temperature", Tags: map[string]string{"room": "living \"room\""}, Value: 20.0},
+		{Measurement: "climate", Fields: map[string]interface{}{"humidity": 40.0, "ok": true}},
+		{Measurement: "status", Value: "online"},
+	})
+	now = now.Add(4 * time.Minute)
+	e.Write([]mqlux.Record{
+		{Measurement: "temperature", Tags: map[string]string{"room": "kitchen", "sensor-type": "dht22"}, Value: 22.0},
+	})
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		return string(body)
+	}
+
+	want := `# TYPE mqlux_climate_humidity gauge
+mqlux_climate_humidity 40
+# TYPE mqlux_climate_ok gauge
+mqlux_climate_ok 1
+# TYPE mqlux_temperature gauge
+mqlux_temperature{room="kitchen",sensor_type="dht22"} 22
+mqlux_temperature{room="living \"room\""} 20
+`
+	if actual := scrape(); actual != want {
+		t.Errorf("unexpected metrics:\n%s\nwant:\n%s", actual, want)
+	}
+
+	now = now.Add(2 * time.Minute)
+	want = `# TYPE mqlux_temperature gauge
+mqlux_temperature{room="kitchen",sensor_type="dht22"} 22
+`
+	if actual := scrape(); actual != want {
+		t.Errorf("unexpected metrics after expiry:\n%s\nwant:\n%s", actual, want)
+	}
+}
+
+func TestExpireOnWrite(t *testing.T) {
+	now := time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)
+	e := New("mqlux_", 5*time.Minute)
+	e.now = func() time.Time { return now }
+
+	// a new series for each write, without scrapes
+	for i := 0; i < 100; i++ {
+		e.Write([]mqlux.Record{
+			{Measurement: "temperature", Tags: map[string]string{"sensor": strconv.Itoa(i)}, Value: 21.5},
+		})
+		now = now.Add(time.Minute)
+	}
+	// series are removed once per expiry, the last write was 1 minute ago
+	if n := len(e.series); n > 10 {
+		t.Errorf("expired series not removed, %d series left", n)
+	}
+}
@@ -0,0 +1,83 @@
+package prometheus
+
+import "math"
+
+// timeSeries is a series with all samples of one remote write request.
+type timeSeries struct {
+	labels  []label
+	samples []remoteSample
+}
+
+type remoteSample struct {
+	value float64
+	// timestamp in milliseconds since epoch
+	timestamp int64
+}
+
+// encodeWriteRequest encodes the series as a remote write request in the
+// protobuf wire format. This implements the following subset of
+// prometheus/prompb, so that we do not depend on generated code:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []timeSeries) []byte {
+	var buf, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = appendString(msg, 1, l.name)
+			msg = appendString(msg, 2, l.value)
+			ts = appendBytes(ts, 1, msg)
+		}
+		for _, smp := range s.samples {
+			msg = msg[:0]
+			msg = appendKey(msg, 1, wireFixed64)
+			msg = appendFixed64(msg, math.Float64bits(smp.value))
+			msg = appendKey(msg, 2, wireVarint)
+			msg = appendVarint(msg, uint64(smp.timestamp))
+			ts = appendBytes(ts, 2, msg)
+		}
+		buf = appendBytes(buf, 1, ts)
+	}
+	return buf
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendKey(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendKey(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	b = appendKey(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	for i := uint(0); i < 64; i += 8 {
+		b = append(b, byte(v>>i))
+	}
+	return b
+}
@@ -0,0 +1,142 @@
+package prometheus
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/retry"
+)
+
+// remoteWriteStats exports the number of written samples and write errors as
+// remote_write in /debug/vars.
+var remoteWriteStats = expvar.NewMap("remote_write")
+
+// RemoteWriter sends records to a Prometheus remote_write endpoint (e.g.
+// Prometheus, VictoriaMetrics, Mimir or Thanos receive).
+type RemoteWriter struct {
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	prefix      string
+	httpClient  *http.Client
+	backoff     retry.Backoff
+}
+
+// NewRemoteWriter creates a new RemoteWriter.
+func NewRemoteWriter(conf config.RemoteWrite) (*RemoteWriter, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("remote_write url requires http or https scheme")
+	}
+
+	return &RemoteWriter{
+		url:         u.String(),
+		username:    conf.Username,
+		password:    conf.Password,
+		bearerToken: conf.BearerToken,
+		prefix:      conf.Prefix,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+		backoff:     retry.DefaultBackoff(retry.Attempts(conf.Retries)),
+	}, nil
+}
+
+// Write sends all numeric fields of the records as samples. Records with the
+// same measurement, field and tags are sent as a single time series.
+// Transient errors are retried.
+func (w *RemoteWriter) Write(recs []mqlux.Record) error {
+	series := w.timeSeries(recs)
+	if len(series) == 0 {
+		return nil
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+
+	err := w.backoff.Do(func() error {
+		return w.post(body)
+	}, func(err error, delay time.Duration) {
+		remoteWriteStats.Add("retries", 1)
+		log.Printf("warning: remote write of %d series, retrying in %s: %s", len(series), delay, err)
+	})
+	if err != nil {
+		remoteWriteStats.Add("errors", 1)
+		return err
+	}
+	for _, s := range series {
+		remoteWriteStats.Add("samples_written", int64(len(s.samples)))
+	}
+	return nil
+}
+
+// timeSeries groups the samples of all records by series. The samples of each
+// series are sorted by time, as required by remote_write.
+func (w *RemoteWriter) timeSeries(recs []mqlux.Record) []timeSeries {
+	var result []timeSeries
+	index := make(map[string]int)
+	for _, rec := range recs {
+		t := rec.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		ms := t.UnixNano() / int64(time.Millisecond)
+		for _, smp := range samples(w.prefix, rec) {
+			key := seriesKey(smp.name, smp.labels)
+			i, ok := index[key]
+			if !ok {
+				labels := make([]label, 0, len(smp.labels)+1)
+				labels = append(labels, label{name: "__name__", value: smp.name})
+				labels = append(labels, smp.labels...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				i = len(result)
+				index[key] = i
+				result = append(result, timeSeries{labels: labels})
+			}
+			result[i].samples = append(result[i].samples, remoteSample{value: smp.value, timestamp: ms})
+		}
+	}
+	for _, s := range result {
+		sort.SliceStable(s.samples, func(i, j int) bool { return s.samples[i].timestamp < s.samples[j].timestamp })
+	}
+	return result
+}
+
+func (w *RemoteWriter) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", "mqlux")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.bearerToken)
+	} else if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return retry.StatusError(resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
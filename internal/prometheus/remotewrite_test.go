@@ -0,0 +1,229 @@
+package prometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/retry"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	var requests []*http.Request
+	var received [][]timeSeries
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		body, _ := ioutil.ReadAll(r.Body)
+		buf, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Error(err)
+		}
+		series, err := decodeWriteRequest(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		received = append(received, series)
+	}))
+	defer s.Close()
+
+	w, err := NewRemoteWriter(config.RemoteWrite{URL: s.URL + "/api/v1/write", BearerToken: "secret", Prefix: "mqlux_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Unix(1517486400, 123456789)
+	err = w.Write([]mqlux.Record{
+		{Measurement: "temperature", Tags: map[string]string{"room": "kitchen", "Z": "z"}, Value: 22.0, Time: t0.Add(time.Second)},
+		{Measurement: "temperature", Tags: map[string]string{"room": "kitchen", "Z": "z"}, Value: 21.5, Time: t0},
+		{Measurement: "climate", Fields: map[string]interface{}{"humidity": 40}, Time: t0},
+		{Measurement: "status", Value: "online", Time: t0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 {
+		t.Fatalf("expected one request, got %d", len(requests))
+	}
+	for header, want := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"Authorization":                     "Bearer secret",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if actual := requests[0].Header.Get(header); actual != want {
+			t.Errorf("unexpected %s header %q != %q", header, actual, want)
+		}
+	}
+	if requests[0].URL.Path != "/api/v1/write" {
+		t.Errorf("unexpected path %s", requests[0].URL.Path)
+	}
+
+	want := []timeSeries{
+		{
+			labels: []label{{"Z", "z"}, {"__name__", "mqlux_temperature"}, {"room", "kitchen"}},
+			samples: []remoteSample{
+				{value: 21.5, timestamp: 1517486400123},
+				{value: 22.0, timestamp: 1517486401123},
+			},
+		},
+		{
+			labels:  []label{{"__name__", "mqlux_climate_humidity"}},
+			samples: []remoteSample{{value: 40, timestamp: 1517486400123}},
+		},
+	}
+	if !reflect.DeepEqual(received[0], want) {
+		t.Errorf("unexpected series\n%v\n!=\n%v", received[0], want)
+	}
+}
+
+func TestRemoteWriteErrors(t *testing.T) {
+	var status []int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := status[0]
+		status = status[1:]
+		w.WriteHeader(code)
+	}))
+	defer s.Close()
+
+	w, err := NewRemoteWriter(config.RemoteWrite{URL: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backoff = retry.Backoff{Attempts: 3, Min: time.Millisecond, Max: time.Millisecond}
+	recs := []mqlux.Record{{Measurement: "temperature", Value: 21.5}}
+
+	// retry server errors
+	status = []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusNoContent}
+	if err := w.Write(recs); err != nil {
+		t.Error(err)
+	}
+
+	// do not retry invalid requests
+	status = []int{http.StatusBadRequest, http.StatusNoContent}
+	if err := w.Write(recs); err == nil || !retry.IsPermanent(err) {
+		t.Error("expected permanent error, got", err)
+	}
+	if len(status) != 1 {
+		t.Error("bad request was retried")
+	}
+
+	// no request for records without numeric values
+	if err := w.Write([]mqlux.Record{{Measurement: "status", Value: "online"}}); err != nil {
+		t.Error(err)
+	}
+	if len(status) != 1 {
+		t.Error("unexpected request for string values")
+	}
+}
+
+func TestNewRemoteWriter(t *testing.T) {
+	if _, err := NewRemoteWriter(config.RemoteWrite{URL: "localhost:9090"}); err == nil {
+		t.Error("expected error for url without scheme")
+	}
+}
+
+// decodeWriteRequest decodes the subset of the protobuf WriteRequest that is
+// written by encodeWriteRequest.
+func decodeWriteRequest(b []byte) ([]timeSeries, error) {
+	var result []timeSeries
+	err := decodeFields(b, func(field int, v uint64, msg []byte) error {
+		if field != 1 {
+			return fmt.Errorf("unexpected field %d in WriteRequest", field)
+		}
+		var ts timeSeries
+		err := decodeFields(msg, func(field int, v uint64, msg []byte) error {
+			switch field {
+			case 1:
+				var l label
+				err := decodeFields(msg, func(field int, v uint64, msg []byte) error {
+					if field == 1 {
+						l.name = string(msg)
+					} else {
+						l.value = string(msg)
+					}
+					return nil
+				})
+				ts.labels = append(ts.labels, l)
+				return err
+			case 2:
+				var smp remoteSample
+				err := decodeFields(msg, func(field int, v uint64, msg []byte) error {
+					if field == 1 {
+						smp.value = math.Float64frombits(v)
+					} else {
+						smp.timestamp = int64(v)
+					}
+					return nil
+				})
+				ts.samples = append(ts.samples, smp)
+				return err
+			}
+			return fmt.Errorf("unexpected field %d in TimeSeries", field)
+		})
+		result = append(result, ts)
+		return err
+	})
+	return result, err
+}
+
+// decodeFields calls fn for each field of the protobuf message. v contains
+// varint and fixed64 values, msg contains length-delimited values.
+func decodeFields(b []byte, fn func(field int, v uint64, msg []byte) error) error {
+	varint := func() (uint64, error) {
+		var v uint64
+		for shift := uint(0); len(b) > 0; shift += 7 {
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return v, nil
+			}
+		}
+		return 0, fmt.Errorf("truncated varint")
+	}
+	for len(b) > 0 {
+		key, err := varint()
+		if err != nil {
+			return err
+		}
+		var v uint64
+		var msg []byte
+		switch key & 7 {
+		case wireVarint:
+			if v, err = varint(); err != nil {
+				return err
+			}
+		case wireFixed64:
+			if len(b) < 8 {
+				return fmt.Errorf("truncated fixed64")
+			}
+			for i := uint(0); i < 8; i++ {
+				v |= uint64(b[i]) << (8 * i)
+			}
+			b = b[8:]
+		case wireBytes:
+			n, err := varint()
+			if err != nil {
+				return err
+			}
+			if uint64(len(b)) < n {
+				return fmt.Errorf("truncated message")
+			}
+			msg, b = b[:n], b[n:]
+		default:
+			return fmt.Errorf("unexpected wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), v, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package retry
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Backoff retries failed operations with a jittered exponential backoff.
+type Backoff struct {
+	// Attempts is the maximum number of attempts (including the first).
+	Attempts int
+	// Min is the delay after the first attempt. The delay doubles after each
+	// attempt.
+	Min time.Duration
+	// Max limits the delay between two attempts.
+	Max time.Duration
+
+	// sleep is replaced in tests
+	sleep func(time.Duration)
+}
+
+// DefaultBackoff returns a Backoff with the given number of attempts, starting
+// with a delay of one second.
+func DefaultBackoff(attempts int) Backoff {
+	return Backoff{Attempts: attempts, Min: time.Second, Max: 30 * time.Second}
+}
+
+// Attempts returns the number of attempts for the configured number of
+// retries. 0 is the default of 3 retries, negative values disable retries.
+func Attempts(retries int) int {
+	switch {
+	case retries == 0:
+		return 4
+	case retries < 0:
+		return 1
+	}
+	return retries + 1
+}
+
+// Do calls fn until it succeeds, until it returns a permanent error or until
+// all attempts failed. It returns the last error. retried is called before
+// each retry.
+func (b Backoff) Do(fn func() error, retried func(err error, delay time.Duration)) error {
+	sleep := b.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	delay := b.Min
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || IsPermanent(err) || attempt >= b.Attempts {
+			return err
+		}
+		// full jitter between delay/2 and delay
+		d := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if retried != nil {
+			retried(err, d)
+		}
+		sleep(d)
+		delay *= 2
+		if delay > b.Max {
+			delay = b.Max
+		}
+	}
+}
+
+// permanentError marks errors that will not succeed on retry.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+// Permanent marks err as permanent. Do does not retry permanent errors.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent checks whether err was marked as permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// statusError is a failed HTTP request.
+type statusError struct {
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("received status code %d: %s", e.status, e.body)
+}
+
+// StatusError returns an error for a failed HTTP request. Client errors
+// (4xx) are permanent, except for timeouts and rate limits. Server errors (5xx)
+// are transient.
+func StatusError(status int, body string) error {
+	err := &statusError{status: status, body: body}
+	if status >= 400 && status < 500 &&
+		status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
+
+// StatusCode returns the HTTP status code of an error from StatusError, or 0
+// for all other errors.
+func StatusCode(err error) int {
+	if p, ok := err.(*permanentError); ok {
+		err = p.err
+	}
+	if s, ok := err.(*statusError); ok {
+		return s.status
+	}
+	return 0
+}
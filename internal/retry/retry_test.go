@@ -0,0 +1,108 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for _, test := range []struct {
+		Name     string
+		Errors   []error
+		Attempts int
+		Calls    int
+		Delays   []time.Duration // upper bound of each delay
+		Error    bool
+	}{
+		{Name: "success", Errors: []error{nil}, Attempts: 3, Calls: 1},
+		{
+			Name:     "transient",
+			Errors:   []error{errors.New("timeout"), errors.New("timeout"), nil},
+			Attempts: 5,
+			Calls:    3,
+			Delays:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			Name:     "exhausted",
+			Errors:   []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout")},
+			Attempts: 3,
+			Calls:    3,
+			Delays:   []time.Duration{time.Second, 2 * time.Second},
+			Error:    true,
+		},
+		{
+			Name:     "permanent",
+			Errors:   []error{Permanent(errors.New("bad request"))},
+			Attempts: 3,
+			Calls:    1,
+			Error:    true,
+		},
+		{
+			Name:     "max delay",
+			Errors:   []error{errors.New("1"), errors.New("2"), errors.New("3"), errors.New("4"), nil},
+			Attempts: 5,
+			Calls:    5,
+			Delays:   []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			var delays []time.Duration
+			b := Backoff{
+				Attempts: test.Attempts, Min: time.Second, Max: 3 * time.Second,
+				sleep: func(d time.Duration) { delays = append(delays, d) },
+			}
+			calls := 0
+			err := b.Do(func() error {
+				err := test.Errors[calls]
+				calls++
+				return err
+			}, nil)
+			if (err != nil) != test.Error {
+				t.Errorf("unexpected error %v", err)
+			}
+			if calls != test.Calls {
+				t.Errorf("unexpected number of calls %d != %d", calls, test.Calls)
+			}
+			if len(delays) != len(test.Delays) {
+				t.Fatalf("unexpected delays %v", delays)
+			}
+			for i, d := range delays {
+				if d > test.Delays[i] || d < test.Delays[i]/2 {
+					t.Errorf("delay %d not between %s and %s", d, test.Delays[i]/2, test.Delays[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	for retries, want := range map[int]int{0: 4, 1: 2, 5: 6, -1: 1} {
+		if actual := Attempts(retries); actual != want {
+			t.Errorf("Attempts(%d) = %d, want %d", retries, actual, want)
+		}
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	for status, permanent := range map[int]bool{
+		400: true,
+		401: true,
+		404: true,
+		408: false,
+		429: false,
+		500: false,
+		503: false,
+	} {
+		err := StatusError(status, "")
+		if IsPermanent(err) != permanent {
+			t.Errorf("status %d: permanent != %v", status, permanent)
+		}
+		if StatusCode(err) != status {
+			t.Errorf("unexpected status code %d != %d", StatusCode(err), status)
+		}
+	}
+	if StatusCode(Permanent(errors.New("bad request"))) != 0 {
+		t.Error("unexpected status code for other error")
+	}
+}
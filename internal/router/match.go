@@ -0,0 +1,53 @@
+package router
+
+import (
+	"errors"
+	"strings"
+)
+
+// ValidateFilter checks whether filter is a valid MQTT topic filter.
+// The + wildcard needs to occupy a whole level and # is only allowed as the
+// last level.
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return errors.New("empty topic filter")
+	}
+	path := strings.Split(filter, "/")
+	for i, p := range path {
+		if p == "#" {
+			if i != len(path)-1 {
+				return errors.New("# wildcard is only allowed at the end of filter " + filter)
+			}
+		} else if p != "+" && strings.ContainsAny(p, "+#") {
+			return errors.New("wildcards need to occupy a whole level in filter " + filter)
+		}
+	}
+	return nil
+}
+
+// Match checks whether the topic matches the MQTT topic filter.
+func Match(filter, topic string) bool {
+	return match(strings.Split(filter, "/"), strings.Split(topic, "/"))
+}
+
+// match checks whether the topic path matches the filter path.
+// Topics starting with $ (e.g. $SYS) are not matched by filters starting with
+// a wildcard.
+func match(filter, topic []string) bool {
+	if (filter[0] == "#" || filter[0] == "+") && strings.HasPrefix(topic[0], "$") {
+		return false
+	}
+	for i, f := range filter {
+		if f == "#" {
+			// # also matches the parent level (foo/# matches foo)
+			return true
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if f != "+" && f != topic[i] {
+			return false
+		}
+	}
+	return len(filter) == len(topic)
+}
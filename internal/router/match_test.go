@@ -0,0 +1,73 @@
+package router
+
+import "testing"
+
+func TestValidateFilter(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		valid  bool
+	}{
+		{filter: "", valid: false},
+		{filter: "/", valid: true},
+		{filter: "#", valid: true},
+		{filter: "+", valid: true},
+		{filter: "/foo/bar", valid: true},
+		{filter: "/foo/#", valid: true},
+		{filter: "/foo/+/bar", valid: true},
+		{filter: "+/+/#", valid: true},
+		{filter: "/foo/#/bar", valid: false},
+		{filter: "/foo#", valid: false},
+		{filter: "/foo/bar+", valid: false},
+		{filter: "/foo/+bar/baz", valid: false},
+	} {
+		err := ValidateFilter(test.filter)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateFilter(%q) = %v, want valid=%v", test.filter, err, test.valid)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{filter: "/foo/bar", topic: "/foo/bar", match: true},
+		{filter: "/foo/bar", topic: "/foo/baz", match: false},
+		{filter: "/foo/bar", topic: "/foo/bar/baz", match: false},
+		{filter: "/foo/bar/baz", topic: "/foo/bar", match: false},
+
+		{filter: "#", topic: "/foo/bar", match: true},
+		{filter: "#", topic: "foo", match: true},
+		{filter: "/#", topic: "/foo/bar", match: true},
+		{filter: "/#", topic: "foo/bar", match: false},
+		{filter: "/foo/#", topic: "/foo", match: true},
+		{filter: "/foo/#", topic: "/foo/", match: true},
+		{filter: "/foo/#", topic: "/foo/bar/baz", match: true},
+		{filter: "/foo/#", topic: "/bar/foo", match: false},
+
+		{filter: "+", topic: "foo", match: true},
+		{filter: "+", topic: "/foo", match: false},
+		{filter: "+/+", topic: "/foo", match: true},
+		{filter: "/+", topic: "/foo", match: true},
+		{filter: "/+", topic: "/foo/bar", match: false},
+		{filter: "/foo/+", topic: "/foo/", match: true},
+		{filter: "/foo/+", topic: "/foo", match: false},
+		{filter: "/+/bar", topic: "/foo/bar", match: true},
+		{filter: "/+/bar", topic: "/foo/baz", match: false},
+		{filter: "/+/+/temp", topic: "/sensors/kitchen/temp", match: true},
+		{filter: "/+/bar/#", topic: "/foo/bar/baz/qux", match: true},
+		{filter: "/+/bar/#", topic: "/foo/bar", match: true},
+
+		{filter: "#", topic: "$SYS/broker/uptime", match: false},
+		{filter: "+/broker/uptime", topic: "$SYS/broker/uptime", match: false},
+		{filter: "$SYS/#", topic: "$SYS/broker/uptime", match: true},
+		{filter: "$SYS/+/uptime", topic: "$SYS/broker/uptime", match: true},
+		{filter: "/#", topic: "/$foo/bar", match: true},
+	} {
+		if actual := Match(test.filter, test.topic); actual != test.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", test.filter, test.topic, actual, test.match)
+		}
+	}
+}
@@ -1,10 +1,9 @@
 package router
 
 import (
-	"fmt"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ktt-ol/mqlux/internal/mqlux"
 )
@@ -19,74 +18,102 @@ func New() *Router {
 	return &Router{}
 }
 
+// Router dispatches messages to all receivers with a matching topic filter.
+//
+// All filters are stored in a trie with one node for each topic level.
+// The trie is (re)built on the first look up after Add and is read-only
+// afterwards, so that look ups do not require any locking.
 type Router struct {
-	topics []handler
-	sorted bool
-	mu     sync.RWMutex
+	handlers []handler
+	trie     atomic.Value // *node, nil if handlers changed
+	mu       sync.Mutex
 }
 
-// Add adds a new path to the router and assigns it to a handler.
-// The path can end with # to match any sub-path.
-// The + wildcard is not supported.
-func (r *Router) Add(topic string, h Receiver) {
+// Add adds a new MQTT topic filter to the router and assigns it to a handler.
+// The filter can end with # to match any sub-path and it can contain +
+// to match a single level.
+func (r *Router) Add(topic string, h Receiver) error {
+	if err := ValidateFilter(topic); err != nil {
+		return err
+	}
 	path := strings.Split(topic, "/")
 	r.mu.Lock()
-	r.sorted = false
-	r.topics = append(r.topics, handler{path: path, Receiver: h})
+	r.handlers = append(r.handlers, handler{path: path, Receiver: h})
+	r.trie.Store((*node)(nil))
 	r.mu.Unlock()
+	return nil
 }
 
+// Find returns all receivers with a filter that matches the topic.
+// Receivers of exact filters are returned before receivers of # filters
+// (longest filter first). Receivers of + filters are returned before the
+// # filters of their parent levels.
+// The returned slice is shared and must not be modified.
 func (r *Router) Find(topic string) []Receiver {
-	path := strings.Split(topic, "/")
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	for !r.sorted {
-		// need to sort r.topic, upgrade read lock to lock
-		// uses for !r.sorted to prevent race condition
-		r.mu.RUnlock()
-		r.mu.Lock()
-		sort.Sort(byPath(r.topics))
-		r.sorted = true
-		r.mu.Unlock()
-		r.mu.RLock()
+	root, _ := r.trie.Load().(*node)
+	if root == nil {
+		root = r.build()
 	}
 
-	result := r.find(path, nil)
-	wildcard := make([]string, len(path)+1)
-	copy(wildcard, path)
-	for i := len(path); i >= 0; i-- {
-		wildcard[i] = "#"
-		wildcard = wildcard[:i+1]
-		result = r.find(wildcard, result)
+	// Fast path: follow the levels of the topic and return the precompiled
+	// handlers of the last node. This only works if there are no +
+	// wildcards along the path (otherwise we need to follow multiple
+	// paths) and if the topic does not start with $ (as leading wildcards
+	// do not match these topics).
+	if strings.HasPrefix(topic, "$") {
+		return root.collect(strings.Split(topic, "/"), true, nil)
+	}
+	n := root
+	rest := topic
+	for {
+		if n.plus != nil {
+			return root.collect(strings.Split(topic, "/"), true, nil)
+		}
+		level := rest
+		i := strings.IndexByte(rest, '/')
+		if i >= 0 {
+			level = rest[:i]
+		}
+		child := n.children[level]
+		if child == nil {
+			return n.partial
+		}
+		n = child
+		if i < 0 {
+			return n.matched
+		}
+		rest = rest[i+1:]
 	}
-	return result
 }
 
-func (r *Router) find(path []string, result []Receiver) []Receiver {
-	i := sort.Search(len(r.topics), func(i int) bool {
-		for j, p := range path {
-			if len(r.topics[i].path) < j+1 {
-				return false
-			}
-			if r.topics[i].path[j] < p {
-				return false
-			} else if r.topics[i].path[j] > p {
-				return true
-			}
-		}
-		return true
-	})
-	if i >= 0 && i < len(r.topics) {
-		for j := i; j < len(r.topics); j++ {
-			if identical(r.topics[j].path, path) {
-				result = append(result, r.topics[j].Receiver)
-			} else {
+// build creates a new trie from all handlers.
+func (r *Router) build() *node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if root, _ := r.trie.Load().(*node); root != nil {
+		// trie was built while we were waiting for the lock
+		return root
+	}
+
+	root := &node{}
+	for _, h := range r.handlers {
+		n := root
+		for _, p := range h.path {
+			if p == "#" {
+				n.hash = append(n.hash, h.Receiver)
+				n = nil
 				break
 			}
+			n = n.child(p)
+		}
+		if n != nil {
+			n.exact = append(n.exact, h.Receiver)
 		}
 	}
-	return result
+	root.compile(nil)
+	r.trie.Store(root)
+	return root
 }
 
 func (r *Router) Receive(msg mqlux.Message) {
@@ -97,54 +124,90 @@ func (r *Router) Receive(msg mqlux.Message) {
 	}
 }
 
-// hasPrefix checks whether paths starts with prefix
-func hasPrefix(path, prefix []string) bool {
-	fmt.Println(path, prefix)
-	for i := range prefix {
-		if len(path) < i+1 {
-			return false
-		}
-		if path[i] != prefix[i] {
-			return false
-		}
-	}
-	return true
+type handler struct {
+	path []string
+	Receiver
 }
 
-// identical checks whether both paths are identical
-func identical(a, b []string) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i := range a {
-		if a[i] != b[i] {
-			return false
+// node is a single topic level of the trie.
+type node struct {
+	children map[string]*node
+	// plus is the child for the + wildcard
+	plus *node
+	// exact are the handlers of all filters that end at this level
+	exact []Receiver
+	// hash are the handlers of all filters that end with # after this level
+	hash []Receiver
+
+	// partial are the precompiled handlers for topics with more levels than
+	// this node (hash of this node and all parents)
+	partial []Receiver
+	// matched are the precompiled handlers for topics that end at this
+	// node (exact and partial)
+	matched []Receiver
+}
+
+func (n *node) child(level string) *node {
+	if level == "+" {
+		if n.plus == nil {
+			n.plus = &node{}
 		}
+		return n.plus
+	}
+	if n.children == nil {
+		n.children = make(map[string]*node)
+	}
+	c, ok := n.children[level]
+	if !ok {
+		c = &node{}
+		n.children[level] = c
 	}
-	return true
+	return c
 }
 
-type handler struct {
-	path []string
-	Receiver
+// compile precompiles the handler lists of this node and all children.
+// parent are the partial handlers of the parent node.
+func (n *node) compile(parent []Receiver) {
+	n.partial = concat(n.hash, parent)
+	n.matched = concat(n.exact, n.partial)
+	for _, c := range n.children {
+		c.compile(n.partial)
+	}
+	if n.plus != nil {
+		n.plus.compile(n.partial)
+	}
 }
 
-type byPath []handler
-
-func (p byPath) Len() int      { return len(p) }
-func (p byPath) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
-func (p byPath) Less(i, j int) bool {
-	ap := p[i].path
-	bp := p[j].path
-	for i := range ap {
-		if len(bp) < (i + 1) {
-			return false
+// collect appends the handlers of all filters below this node that match the
+// remaining levels of the topic. It is the slow path of Find that also follows
+// + wildcards.
+func (n *node) collect(levels []string, isRoot bool, result []Receiver) []Receiver {
+	// leading wildcards do not match topics starting with $
+	noWildcard := isRoot && strings.HasPrefix(levels[0], "$")
+
+	if len(levels) == 0 {
+		result = append(result, n.exact...)
+	} else {
+		if c := n.children[levels[0]]; c != nil {
+			result = c.collect(levels[1:], false, result)
 		}
-		if ap[i] < bp[i] {
-			return true
-		} else if ap[i] > bp[i] {
-			return false
+		if n.plus != nil && !noWildcard {
+			result = n.plus.collect(levels[1:], false, result)
 		}
 	}
-	return true
+	if !noWildcard {
+		result = append(result, n.hash...)
+	}
+	return result
+}
+
+// concat returns a new slice with all elements of a and b, or nil if both are
+// empty.
+func concat(a, b []Receiver) []Receiver {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+	result := make([]Receiver, 0, len(a)+len(b))
+	result = append(result, a...)
+	return append(result, b...)
 }
@@ -0,0 +1,154 @@
+package router
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sliceRouter is the previous implementation of Router based on a sorted
+// slice with one binary search for each level of the topic. It is only kept
+// to verify and benchmark the trie based Router.
+type sliceRouter struct {
+	topics []handler
+	// wildcards stores all handlers with a + wildcard in their path
+	wildcards []handler
+	sorted    bool
+	mu        sync.RWMutex
+}
+
+func (r *sliceRouter) Add(topic string, h Receiver) error {
+	if err := ValidateFilter(topic); err != nil {
+		return err
+	}
+	path := strings.Split(topic, "/")
+	r.mu.Lock()
+	if hasWildcard(path) {
+		r.wildcards = append(r.wildcards, handler{path: path, Receiver: h})
+	} else {
+		r.sorted = false
+		r.topics = append(r.topics, handler{path: path, Receiver: h})
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *sliceRouter) Find(topic string) []Receiver {
+	path := strings.Split(topic, "/")
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for !r.sorted {
+		// need to sort r.topic, upgrade read lock to lock
+		// uses for !r.sorted to prevent race condition
+		r.mu.RUnlock()
+		r.mu.Lock()
+		sort.Sort(byPath(r.topics))
+		r.sorted = true
+		r.mu.Unlock()
+		r.mu.RLock()
+	}
+
+	result := r.find(path, nil)
+	wildcard := make([]string, len(path)+1)
+	copy(wildcard, path)
+	// topics starting with $ are not matched by a leading # (e.g. $SYS/#)
+	minWildcard := 0
+	if strings.HasPrefix(path[0], "$") {
+		minWildcard = 1
+	}
+	for i := len(path); i >= minWildcard; i-- {
+		wildcard[i] = "#"
+		wildcard = wildcard[:i+1]
+		result = r.find(wildcard, result)
+	}
+
+	for _, h := range r.wildcards {
+		if match(h.path, path) {
+			result = append(result, h.Receiver)
+		}
+	}
+	return result
+}
+
+func (r *sliceRouter) find(path []string, result []Receiver) []Receiver {
+	i := sort.Search(len(r.topics), func(i int) bool {
+		for j, p := range path {
+			if len(r.topics[i].path) < j+1 {
+				return false
+			}
+			if r.topics[i].path[j] < p {
+				return false
+			} else if r.topics[i].path[j] > p {
+				return true
+			}
+		}
+		return true
+	})
+	if i >= 0 && i < len(r.topics) {
+		for j := i; j < len(r.topics); j++ {
+			if identical(r.topics[j].path, path) {
+				result = append(result, r.topics[j].Receiver)
+			} else {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// hasPrefix checks whether paths starts with prefix
+func hasPrefix(path, prefix []string) bool {
+	for i := range prefix {
+		if len(path) < i+1 {
+			return false
+		}
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// identical checks whether both paths are identical
+func identical(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type byPath []handler
+
+func (p byPath) Len() int      { return len(p) }
+func (p byPath) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPath) Less(i, j int) bool {
+	ap := p[i].path
+	bp := p[j].path
+	for i := range ap {
+		if len(bp) < (i + 1) {
+			return false
+		}
+		if ap[i] < bp[i] {
+			return true
+		} else if ap[i] > bp[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasWildcard checks whether the path contains a + wildcard.
+func hasWildcard(path []string) bool {
+	for _, p := range path {
+		if p == "+" {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"fmt"
 	"math/rand"
 	"reflect"
 	"sort"
@@ -159,12 +160,45 @@ func TestRouter(t *testing.T) {
 				0, // "/a/#"
 			},
 		},
+		{
+			input: []string{
+				"/a/+/x",
+				"/a/a/x",
+				"/+/a/#",
+				"/a/+",
+				"+/a/a/x",
+				"/a/#",
+			},
+			search: "/a/a/x",
+			want: []int{
+				1, // "/a/a/x"
+				0, // "/a/+/x"
+				5, // "/a/#"
+				2, // "/+/a/#"
+				4, // "+/a/a/x"
+			},
+		},
+		{
+			input: []string{
+				"#",
+				"+/broker/uptime",
+				"$SYS/#",
+				"$SYS/+/uptime",
+			},
+			search: "$SYS/broker/uptime",
+			want: []int{
+				3, // "$SYS/+/uptime"
+				2, // "$SYS/#"
+			},
+		},
 	} {
 		r := New()
 		hs := []Receiver{}
 		for _, path := range test.input {
 			h := dummyHandler{path: path}
-			r.Add(path, &h)
+			if err := r.Add(path, &h); err != nil {
+				t.Fatal(err)
+			}
 			hs = append(hs, &h)
 		}
 		result := r.Find(test.search)
@@ -180,41 +214,6 @@ func TestRouter(t *testing.T) {
 	}
 }
 
-func BenchmarkRouter(b *testing.B) {
-	r := New()
-	randomPath := func() string {
-		length := rand.Intn(4) + 2
-		path := make([]string, length)
-		for i := range path {
-			path[i] = string('a'+rand.Intn(26)) + string('a'+rand.Intn(26))
-		}
-		if rand.Intn(10) == 0 {
-			path[length-1] = "#"
-		}
-		return strings.Join(path, "/")
-	}
-	for i := 0; i < 100000; i++ {
-		r.Add(randomPath(), nil)
-	}
-	// first Find is slow as it sorts our topics
-	r.Find(randomPath())
-
-	b.ResetTimer()
-	b.ReportAllocs()
-
-	found := 0
-	topics := 0
-	for n := 0; n < b.N; n++ {
-		search := randomPath()
-		results := len(r.Find(search))
-		if results > 0 {
-			found++
-			topics += results
-		}
-	}
-	b.Log(b.N, found, float64(topics)/float64(found))
-}
-
 func TestHasPrefix(t *testing.T) {
 	for _, test := range []struct {
 		path     []string
@@ -234,3 +233,96 @@ func TestHasPrefix(t *testing.T) {
 		}
 	}
 }
+
+type router interface {
+	Add(topic string, h Receiver) error
+	Find(topic string) []Receiver
+}
+
+// randomPath returns a random topic or filter with 2-5 levels. Each level
+// is selected from n different names.
+func randomPath(rnd *rand.Rand, n int, wildcards bool) string {
+	length := rnd.Intn(4) + 2
+	path := make([]string, length)
+	for i := range path {
+		path[i] = fmt.Sprintf("l%d", rnd.Intn(n))
+		if wildcards && rnd.Intn(20) == 0 {
+			path[i] = "+"
+		}
+	}
+	if wildcards && rnd.Intn(10) == 0 {
+		path[length-1] = "#"
+	}
+	return strings.Join(path, "/")
+}
+
+func TestRouterMatchesSliceRouter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	trie := New()
+	slice := &sliceRouter{}
+	for i := 0; i < 2000; i++ {
+		h := &dummyHandler{path: randomPath(rnd, 5, true)}
+		if err := trie.Add(h.path, h); err != nil {
+			t.Fatal(err)
+		}
+		if err := slice.Add(h.path, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byTopic := func(recv []Receiver) []string {
+		var topics []string
+		for _, r := range recv {
+			topics = append(topics, r.(*dummyHandler).path)
+		}
+		sort.Strings(topics)
+		return topics
+	}
+	for i := 0; i < 2000; i++ {
+		search := randomPath(rnd, 5, false)
+		want := byTopic(slice.Find(search))
+		actual := byTopic(trie.Find(search))
+		if !reflect.DeepEqual(actual, want) {
+			t.Errorf("unexpected result for %s %v != %v", search, actual, want)
+		}
+	}
+}
+
+func benchmarkRouter(b *testing.B, r router, filters, levels int) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < filters; i++ {
+		h := &dummyHandler{path: randomPath(rnd, levels, true)}
+		r.Add(h.path, h)
+	}
+	searches := make([]string, 1024)
+	for i := range searches {
+		searches[i] = randomPath(rnd, levels, false)
+	}
+	// first Find is slow as it sorts/builds our topics
+	r.Find(searches[0])
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		r.Find(searches[n%len(searches)])
+	}
+}
+
+func BenchmarkRouter(b *testing.B) {
+	for _, bench := range []struct {
+		name            string
+		filters, levels int
+	}{
+		{name: "100", filters: 100, levels: 5},
+		{name: "1000", filters: 1000, levels: 10},
+		{name: "100000", filters: 100000, levels: 26 * 26},
+	} {
+		b.Run("trie/"+bench.name, func(b *testing.B) {
+			benchmarkRouter(b, New(), bench.filters, bench.levels)
+		})
+		b.Run("slice/"+bench.name, func(b *testing.B) {
+			benchmarkRouter(b, &sliceRouter{}, bench.filters, bench.levels)
+		})
+	}
+}
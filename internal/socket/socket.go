@@ -0,0 +1,223 @@
+// Package socket sends records in the InfluxDB line protocol over UDP (e.g.
+// to the InfluxDB UDP listener or to the Telegraf socket_listener) or TCP
+// (e.g. to QuestDB). Both writers are fire-and-forget: records are not
+// retried or spooled if the receiver is not available.
+package socket
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/lineprotocol"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+// stats exports the number of sent lines and errors as socket in /debug/vars.
+var stats = expvar.NewMap("socket")
+
+// DefaultMaxPacketSize is the default size limit of UDP packets. It keeps
+// packets below the MTU of typical networks.
+const DefaultMaxPacketSize = 1400
+
+const timeout = 10 * time.Second
+
+// UDPWriter sends records as UDP packets. Each packet contains as many lines
+// as fit into the maximum packet size.
+type UDPWriter struct {
+	conn          net.Conn
+	precision     string
+	maxPacketSize int
+}
+
+// NewUDP creates a new UDPWriter for the address of conf.
+func NewUDP(conf config.Socket) (*UDPWriter, error) {
+	if err := lineprotocol.ValidPrecision(conf.Precision); err != nil {
+		return nil, err
+	}
+	if conf.Address == "" {
+		return nil, errors.New("missing address")
+	}
+	conn, err := net.Dial("udp", conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	size := conf.MaxPacketSize
+	if size <= 0 {
+		size = DefaultMaxPacketSize
+	}
+	return &UDPWriter{conn: conn, precision: conf.Precision, maxPacketSize: size}, nil
+}
+
+// Write sends all records. Lines that are larger than the maximum packet
+// size are sent in a packet of their own.
+func (w *UDPWriter) Write(recs []mqlux.Record) error {
+	var firstErr error
+	packet := make([]byte, 0, w.maxPacketSize)
+	lines := 0
+	var line []byte
+	for _, rec := range recs {
+		var err error
+		line, err = lineprotocol.Append(line[:0], rec, w.precision)
+		if err != nil {
+			stats.Add("lines_dropped", 1)
+			log.Printf("error: dropping record: %s", err)
+			continue
+		}
+		if len(packet) > 0 && len(packet)+len(line) > w.maxPacketSize {
+			if err := w.send(packet, lines); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			packet = packet[:0]
+			lines = 0
+		}
+		packet = append(packet, line...)
+		lines++
+	}
+	if len(packet) > 0 {
+		if err := w.send(packet, lines); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (w *UDPWriter) send(packet []byte, lines int) error {
+	if _, err := w.conn.Write(packet); err != nil {
+		stats.Add("udp_errors", 1)
+		return err
+	}
+	stats.Add("udp_packets", 1)
+	stats.Add("lines_written", int64(lines))
+	return nil
+}
+
+// Stop closes the socket.
+func (w *UDPWriter) Stop() {
+	w.conn.Close()
+}
+
+// TCPWriter sends records over a persistent TCP connection. The connection
+// is reestablished after errors.
+type TCPWriter struct {
+	conn      *TCPConn
+	precision string
+}
+
+// NewTCP creates a new TCPWriter for the address of conf. The connection is
+// established with the first write.
+func NewTCP(conf config.Socket) (*TCPWriter, error) {
+	if err := lineprotocol.ValidPrecision(conf.Precision); err != nil {
+		return nil, err
+	}
+	conn, err := NewTCPConn(conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPWriter{conn: conn, precision: conf.Precision}, nil
+}
+
+// Write sends all records.
+func (w *TCPWriter) Write(recs []mqlux.Record) error {
+	var buf []byte
+	lines := 0
+	for _, rec := range recs {
+		var err error
+		buf, err = lineprotocol.Append(buf, rec, w.precision)
+		if err != nil {
+			stats.Add("lines_dropped", 1)
+			log.Printf("error: dropping record: %s", err)
+			continue
+		}
+		lines++
+	}
+	if lines == 0 {
+		return nil
+	}
+	if err := w.conn.Send(buf); err != nil {
+		stats.Add("tcp_errors", 1)
+		return err
+	}
+	stats.Add("lines_written", int64(lines))
+	return nil
+}
+
+// Stop closes the connection.
+func (w *TCPWriter) Stop() {
+	w.conn.Close()
+}
+
+// TCPConn is a persistent TCP connection for line based plaintext
+// protocols. The connection is established with the first Send and
+// reestablished after errors.
+type TCPConn struct {
+	address string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewTCPConn creates a new TCPConn for address (host:port).
+func NewTCPConn(address string) (*TCPConn, error) {
+	if address == "" {
+		return nil, errors.New("missing address")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, err
+	}
+	return &TCPConn{address: address}, nil
+}
+
+// Send writes the lines in buf to the connection. If the write fails (e.g.
+// because the receiver closed the idle connection), all lines that were not
+// completely written are sent again over a new connection. Lines that were
+// written to the failed connection but not processed by the receiver are
+// lost.
+func (c *TCPConn) Send(buf []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reused := c.conn != nil
+	n, err := c.send(buf)
+	if err != nil && reused {
+		log.Printf("warning: writing to %s, reconnecting: %s", c.address, err)
+		// a partial line is discarded by the receiver
+		rest := buf[bytes.LastIndexByte(buf[:n], '\n')+1:]
+		_, err = c.send(rest)
+	}
+	return err
+}
+
+// send writes buf to the current connection and connects if required. It
+// returns the number of written bytes. The connection is closed on errors.
+func (c *TCPConn) send(buf []byte) (int, error) {
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.address, timeout)
+		if err != nil {
+			return 0, err
+		}
+		c.conn = conn
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	n, err := c.conn.Write(buf)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return n, err
+	}
+	return n, nil
+}
+
+// Close closes the connection. The next Send connects again.
+func (c *TCPConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
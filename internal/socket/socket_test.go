@@ -0,0 +1,174 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/socket/sockettest"
+)
+
+var ts = time.Unix(1517486400, 0)
+
+func TestUDP(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	w, err := NewUDP(config.Socket{Address: l.LocalAddr().String(), Precision: "s", MaxPacketSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if err := w.Write(sockettest.Records(10, ts)); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	buf := make([]byte, 1500)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	for len(lines) < 10 {
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 100 {
+			t.Errorf("packet larger than max_packet_size: %d", n)
+		}
+		if buf[n-1] != '\n' {
+			t.Errorf("packet with partial line %q", buf[:n])
+		}
+		lines = append(lines, strings.Split(strings.TrimSpace(string(buf[:n])), "\n")...)
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("temperature,room=room-%d value=%d 1517486400", i, i); line != want {
+			t.Errorf("unexpected line %q != %q", line, want)
+		}
+	}
+}
+
+func TestTCP(t *testing.T) {
+	s := sockettest.NewServer()
+	defer s.Close()
+
+	w, err := NewTCP(config.Socket{Address: s.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	want := []string{
+		"temperature,room=room-0 value=0 1517486400000000000",
+		"temperature,room=room-1 value=1 1517486400000000000",
+		"temperature,room=room-2 value=2 1517486400000000000",
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.Write(sockettest.Records(3, ts)); err != nil {
+			t.Fatal(err)
+		}
+		s.Expect(t, want...)
+		// next write uses a new connection
+		w.Stop()
+	}
+}
+
+func TestTCPReconnect(t *testing.T) {
+	s := sockettest.NewServer()
+	defer s.Close()
+
+	w, err := NewTCP(config.Socket{Address: s.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if err := w.Write(sockettest.Records(1, ts)); err != nil {
+		t.Fatal(err)
+	}
+	s.Expect(t, "temperature,room=room-0 value=0 1517486400000000000")
+
+	// the receiver drops the connection, the records are sent again over a
+	// new connection
+	s.Reset()
+	time.Sleep(50 * time.Millisecond)
+	if err := w.Write(sockettest.Records(2, ts)); err != nil {
+		t.Fatal(err)
+	}
+	s.Expect(t,
+		"temperature,room=room-0 value=0 1517486400000000000",
+		"temperature,room=room-1 value=1 1517486400000000000",
+	)
+}
+
+// partialConn writes only n bytes and fails.
+type partialConn struct {
+	net.Conn
+	n int
+}
+
+func (c partialConn) Write(b []byte) (int, error) {
+	c.Conn.Write(b[:c.n])
+	return c.n, errors.New("connection reset by peer")
+}
+
+func TestTCPPartialWrite(t *testing.T) {
+	s := sockettest.NewServer()
+	defer s.Close()
+
+	c, err := NewTCPConn(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first line and a part of the second line are written
+	c.conn = partialConn{conn, len("line 1\nli")}
+
+	if err := c.Send([]byte("line 1\nline 2\nline 3\n")); err != nil {
+		t.Fatal(err)
+	}
+	// the partial second line is received when the failed connection is
+	// closed
+	var lines []string
+	for len(lines) < 4 {
+		select {
+		case line := <-s.Lines:
+			lines = append(lines, line)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout, got %q", lines)
+		}
+	}
+	sort.Strings(lines)
+	if want := []string{"li", "line 1", "line 2", "line 3"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("unexpected lines %q != %q", lines, want)
+	}
+}
+
+func TestTCPErrors(t *testing.T) {
+	addr := sockettest.ClosedAddr(t)
+	w, err := NewTCP(config.Socket{Address: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(sockettest.Records(1, ts)); err == nil {
+		t.Error("expected error without receiver")
+	}
+
+	if _, err := NewTCP(config.Socket{Address: "localhost"}); err == nil {
+		t.Error("expected error for address without port")
+	}
+	if _, err := NewUDP(config.Socket{Address: addr, Precision: "days"}); err == nil {
+		t.Error("expected error for invalid precision")
+	}
+}
@@ -0,0 +1,120 @@
+// Package sockettest provides a TCP server and records for tests of line
+// based outputs (e.g. socket, graphite or opentsdb).
+package sockettest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+// Server accepts TCP connections on a local port and forwards all received
+// lines.
+type Server struct {
+	Lines chan string
+
+	l     net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// NewServer starts a new Server. It panics if it can not listen, like
+// httptest.NewServer.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("sockettest: failed to listen: %s", err))
+	}
+	s := &Server{Lines: make(chan string), l: l}
+	go s.accept()
+	return s
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go func() {
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				s.Lines <- scanner.Text()
+			}
+		}()
+	}
+}
+
+// Addr returns the address (host:port) of the Server.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Expect checks that the next received lines are want.
+func (s *Server) Expect(t *testing.T, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case line := <-s.Lines:
+			if line != w {
+				t.Errorf("unexpected line %q != %q", line, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", w)
+		}
+	}
+}
+
+// Reset resets all open connections (e.g. a restarted receiver). The
+// clients get an error with their next write.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// Close stops the Server and closes all connections.
+func (s *Server) Close() {
+	s.l.Close()
+	s.Reset()
+}
+
+// ClosedAddr returns a local address without a receiver.
+func ClosedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// Records returns n temperature records with a room tag (room-0, room-1, ...)
+// and the value 0, 1, ...
+func Records(n int, ts time.Time) []mqlux.Record {
+	var recs []mqlux.Record
+	for i := 0; i < n; i++ {
+		recs = append(recs, mqlux.Record{
+			Measurement: "temperature",
+			Tags:        map[string]string{"room": fmt.Sprintf("room-%d", i)},
+			Value:       float64(i),
+			Time:        ts,
+		})
+	}
+	return recs
+}
@@ -0,0 +1,452 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/fieldtype"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentExt = ".spool"
+	// maxSegmentSize is the size after which a new segment is started.
+	maxSegmentSize = 4 << 20
+	// replayBatchSize is the number of records that are replayed with a
+	// single write.
+	replayBatchSize = 1000
+)
+
+// depth exports the spool depth of all spools (by directory) as
+// spool_depth in /debug/vars.
+var depth = expvar.NewMap("spool_depth")
+
+// Spool writes records to another writer and stores all records that could
+// not be written (e.g. during a database outage) in segment files. Stored
+// records are replayed in order with their original timestamps once the
+// writer is available again.
+type Spool struct {
+	dir            string
+	maxSize        int64
+	retention      time.Duration
+	writer         mqlux.Writer
+	replayInterval time.Duration
+
+	mu       sync.Mutex
+	segments []*segment // oldest first
+	current  *os.File   // open file of the last segment, if any
+	nextID   uint64
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type segment struct {
+	id       uint64
+	path     string
+	size     int64
+	records  int
+	replayed int // records that were already replayed
+	created  time.Time
+	modTime  time.Time
+}
+
+// Depth describes the number of stored records.
+type Depth struct {
+	Records  int
+	Bytes    int64
+	Segments int
+}
+
+// New creates a new Spool that stores records in dir. The oldest
+// segments are removed if the spool is larger than maxSize bytes or if they
+// are older than retention (0 for no limit). Existing segments in dir are
+// replayed.
+func New(dir string, maxSize int64, retention time.Duration, writer mqlux.Writer) (*Spool, error) {
+	return newSpool(dir, maxSize, retention, writer, 10*time.Second)
+}
+
+func newSpool(dir string, maxSize int64, retention time.Duration, writer mqlux.Writer, replayInterval time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:            dir,
+		maxSize:        maxSize,
+		retention:      retention,
+		writer:         writer,
+		replayInterval: replayInterval,
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	depth.Set(dir, expvar.Func(func() interface{} { return s.Depth() }))
+	if d := s.Depth(); d.Records > 0 {
+		log.Printf("info: spool %s contains %d records", dir, d.Records)
+	}
+	go s.run()
+	return s, nil
+}
+
+// load adds all existing segments from dir.
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &segment{
+			id:      id,
+			path:    filepath.Join(s.dir, fi.Name()),
+			size:    fi.Size(),
+			created: fi.ModTime(),
+			modTime: fi.ModTime(),
+		}
+		data, err := ioutil.ReadFile(seg.path)
+		if err != nil {
+			return err
+		}
+		seg.records = bytes.Count(data, []byte{'\n'})
+		s.segments = append(s.segments, seg)
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+	return nil
+}
+
+// Write writes the records to the writer. The records are stored in the spool
+// if the writer fails.
+func (s *Spool) Write(recs []mqlux.Record) error {
+	err := s.writer(recs)
+	if err == nil {
+		return nil
+	}
+	log.Printf("warning: spooling %d records: %s", len(recs), err)
+	if err := s.append(recs); err != nil {
+		return errors.Wrap(err, "spooling records")
+	}
+	return nil
+}
+
+// Depth returns the number of records in the spool.
+func (s *Spool) Depth() Depth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := Depth{Segments: len(s.segments)}
+	for _, seg := range s.segments {
+		d.Records += seg.records - seg.replayed
+		d.Bytes += seg.size
+	}
+	return d
+}
+
+// Stop stops the replay of stored records. Records that were not replayed
+// are kept in the spool directory.
+func (s *Spool) Stop() {
+	close(s.done)
+	<-s.stopped
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeCurrent()
+}
+
+func (s *Spool) append(recs []mqlux.Record) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(fromRecord(rec)); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil || s.segmentFull(s.segments[len(s.segments)-1]) {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+	seg := s.segments[len(s.segments)-1]
+	n, err := s.current.Write(buf.Bytes())
+	seg.size += int64(n)
+	seg.modTime = time.Now()
+	if err != nil {
+		return err
+	}
+	seg.records += len(recs)
+	if err := s.current.Sync(); err != nil {
+		return err
+	}
+	s.enforceLimits()
+	return nil
+}
+
+// segmentFull checks whether a new segment should be started. Segments are
+// limited by size and by age, so that old records expire in time.
+func (s *Spool) segmentFull(seg *segment) bool {
+	if seg.size >= maxSegmentSize {
+		return true
+	}
+	return s.retention > 0 && time.Since(seg.created) > s.retention/10
+}
+
+// startSegment closes the current segment and opens a new one.
+// mu needs to be locked.
+func (s *Spool) startSegment() error {
+	s.closeCurrent()
+	seg := &segment{
+		id:      s.nextID,
+		path:    filepath.Join(s.dir, fmt.Sprintf("%016d%s", s.nextID, segmentExt)),
+		created: time.Now(),
+		modTime: time.Now(),
+	}
+	f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+	s.current = f
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// closeCurrent closes the current segment, new records are stored in a new
+// segment. mu needs to be locked.
+func (s *Spool) closeCurrent() {
+	if s.current == nil {
+		return
+	}
+	if err := s.current.Close(); err != nil {
+		log.Println("error: closing spool segment", err)
+	}
+	s.current = nil
+}
+
+// enforceLimits removes the oldest segments if the spool is too large
+// or if they are expired. mu needs to be locked.
+func (s *Spool) enforceLimits() {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		expired := s.retention > 0 && time.Since(seg.modTime) > s.retention
+		tooLarge := s.maxSize > 0 && size > s.maxSize
+		if !expired && !tooLarge {
+			break
+		}
+		if seg == s.segments[len(s.segments)-1] {
+			s.closeCurrent()
+		}
+		if err := os.Remove(seg.path); err != nil {
+			log.Println("error: removing spool segment", err)
+		}
+		log.Printf("warning: dropped %d spooled records (expired: %v, spool too large: %v)",
+			seg.records-seg.replayed, expired, tooLarge)
+		size -= seg.size
+		s.segments = s.segments[1:]
+	}
+}
+
+func (s *Spool) run() {
+	t := time.NewTicker(s.replayInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			s.enforceLimits()
+			s.mu.Unlock()
+			for s.replay() {
+			}
+		case <-s.done:
+			close(s.stopped)
+			return
+		}
+	}
+}
+
+// replay writes the records of the oldest segment and removes it.
+// It returns true if the segment was replayed.
+func (s *Spool) replay() bool {
+	s.mu.Lock()
+	if len(s.segments) == 0 {
+		s.mu.Unlock()
+		return false
+	}
+	seg := s.segments[0]
+	if len(s.segments) == 1 {
+		// new records are written to a new segment
+		s.closeCurrent()
+	}
+	s.mu.Unlock()
+
+	recs, err := readSegment(seg.path)
+	if err != nil {
+		log.Printf("error: reading spool segment %s: %s", seg.path, err)
+		return false
+	}
+
+	replayed := seg.replayed
+	for replayed < len(recs) {
+		n := replayBatchSize
+		if replayed+n > len(recs) {
+			n = len(recs) - replayed
+		}
+		if err := s.writer(recs[replayed : replayed+n]); err != nil {
+			log.Printf("debug: replaying spooled records: %s", err)
+			s.mu.Lock()
+			seg.replayed = replayed
+			s.mu.Unlock()
+			return false
+		}
+		replayed += n
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) > 0 && s.segments[0] == seg {
+		if err := os.Remove(seg.path); err != nil {
+			log.Println("error: removing spool segment", err)
+		}
+		s.segments = s.segments[1:]
+	}
+	log.Printf("info: replayed %d spooled records", len(recs)-seg.replayed)
+	return true
+}
+
+func readSegment(path string) ([]mqlux.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []mqlux.Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var r record
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		// numbers are converted by toRecord
+		dec.UseNumber()
+		if err := dec.Decode(&r); err != nil {
+			// skip partially written records (e.g. after a crash)
+			log.Printf("warning: skipping invalid record in %s: %s", path, err)
+			continue
+		}
+		recs = append(recs, r.toRecord())
+	}
+	return recs, scanner.Err()
+}
+
+// record is the stored JSON representation of a mqlux.Record. JSON does not
+// distinguish integers from floats, so integer values are marked with
+// ValueInteger and IntegerFields.
+type record struct {
+	Measurement     string                 `json:"measurement"`
+	Tags            map[string]string      `json:"tags,omitempty"`
+	Value           interface{}            `json:"value"`
+	ValueInteger    bool                   `json:"value_integer,omitempty"`
+	Fields          map[string]interface{} `json:"fields,omitempty"`
+	IntegerFields   []string               `json:"integer_fields,omitempty"`
+	Time            time.Time              `json:"time"`
+	Database        string                 `json:"database,omitempty"`
+	RetentionPolicy string                 `json:"retention_policy,omitempty"`
+	FieldTypes      string                 `json:"field_types,omitempty"`
+}
+
+func fromRecord(rec mqlux.Record) record {
+	r := record{
+		Measurement:     rec.Measurement,
+		Tags:            rec.Tags,
+		Value:           rec.Value,
+		ValueInteger:    isInteger(rec.Value),
+		Fields:          rec.Fields,
+		Time:            rec.Time,
+		Database:        rec.Database,
+		RetentionPolicy: rec.RetentionPolicy,
+		FieldTypes:      rec.FieldTypes,
+	}
+	for k, v := range rec.Fields {
+		if isInteger(v) {
+			r.IntegerFields = append(r.IntegerFields, k)
+		}
+	}
+	sort.Strings(r.IntegerFields)
+	return r
+}
+
+// toRecord converts r, which was decoded with UseNumber.
+func (r record) toRecord() mqlux.Record {
+	rec := mqlux.Record{
+		Measurement:     r.Measurement,
+		Tags:            r.Tags,
+		Value:           number(r.Value, r.ValueInteger),
+		Time:            r.Time,
+		Database:        r.Database,
+		RetentionPolicy: r.RetentionPolicy,
+		FieldTypes:      r.FieldTypes,
+	}
+	if r.Fields != nil {
+		integers := make(map[string]bool, len(r.IntegerFields))
+		for _, k := range r.IntegerFields {
+			integers[k] = true
+		}
+		rec.Fields = make(map[string]interface{}, len(r.Fields))
+		for k, v := range r.Fields {
+			rec.Fields[k] = number(v, integers[k])
+		}
+	}
+	return rec
+}
+
+func isInteger(v interface{}) bool {
+	typ, _ := fieldtype.TypeOf(v)
+	return typ == fieldtype.Integer
+}
+
+// number converts a json.Number into int64 (if integer) or float64. All other
+// values are returned unchanged.
+func number(v interface{}, integer bool) interface{} {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if integer {
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return n.String()
+	}
+	return f
+}
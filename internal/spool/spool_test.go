@@ -0,0 +1,194 @@
+package spool
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+// flakyWriter fails while down is true and records all written records.
+type flakyWriter struct {
+	mu      sync.Mutex
+	down    bool
+	records []mqlux.Record
+}
+
+func (w *flakyWriter) Write(recs []mqlux.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.down {
+		return errors.New("database down")
+	}
+	w.records = append(w.records, recs...)
+	return nil
+}
+
+func (w *flakyWriter) setDown(down bool) {
+	w.mu.Lock()
+	w.down = down
+	w.mu.Unlock()
+}
+
+func (w *flakyWriter) written() []mqlux.Record {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]mqlux.Record(nil), w.records...)
+}
+
+func records(from, to int) []mqlux.Record {
+	var recs []mqlux.Record
+	for i := from; i < to; i++ {
+		recs = append(recs, mqlux.Record{
+			Measurement: "temperature",
+			Tags:        map[string]string{"room": "kitchen"},
+			Value:       float64(i),
+			Time:        time.Date(2018, 2, 1, 12, 0, i, 0, time.UTC),
+			Database:    "longterm",
+		})
+	}
+	return recs
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mqlux-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := &flakyWriter{down: true}
+	s, err := newSpool(dir, 0, 0, w.Write, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	for i := 0; i < 10; i++ {
+		if err := s.Write(records(i*10, i*10+10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := s.Depth(); d.Records != 100 {
+		t.Errorf("unexpected spool depth %v", d)
+	}
+
+	w.setDown(false)
+	waitFor(t, func() bool { return s.Depth().Records == 0 })
+
+	if actual := w.written(); !reflect.DeepEqual(actual, records(0, 100)) {
+		t.Errorf("unexpected records %v", actual)
+	}
+	if d := s.Depth(); d.Segments != 0 {
+		t.Errorf("segments not removed %v", d)
+	}
+}
+
+func TestSpoolReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := &flakyWriter{down: true}
+	s, err := newSpool(dir, 0, 0, w.Write, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(records(0, 5))
+	s.Write(records(5, 10))
+	s.Stop()
+
+	w.setDown(false)
+	s, err = newSpool(dir, 0, 0, w.Write, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if d := s.Depth(); d.Records != 10 {
+		t.Errorf("unexpected spool depth after reload %v", d)
+	}
+	waitFor(t, func() bool { return s.Depth().Records == 0 })
+	if actual := w.written(); !reflect.DeepEqual(actual, records(0, 10)) {
+		t.Errorf("unexpected records %v", actual)
+	}
+}
+
+func TestSpoolTypes(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := &flakyWriter{down: true}
+	s, err := newSpool(dir, 0, 0, w.Write, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := []mqlux.Record{
+		{Measurement: "counter", Value: int64(42), FieldTypes: "coerce"},
+		{Measurement: "counter", Value: 42.0, Fields: map[string]interface{}{"count": int64(7), "total": 1e3, "state": "on", "on": true}},
+		{Measurement: "counter", Value: int64(-1 << 62)},
+	}
+	for i := range recs {
+		recs[i].Time = time.Date(2018, 2, 1, 12, 0, i, 0, time.UTC)
+	}
+	s.Write(recs)
+	s.Stop()
+
+	w.setDown(false)
+	s, err = newSpool(dir, 0, 0, w.Write, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	waitFor(t, func() bool { return s.Depth().Records == 0 })
+	if actual := w.written(); !reflect.DeepEqual(actual, recs) {
+		t.Errorf("unexpected records\n%#v\n!=\n%#v", actual, recs)
+	}
+}
+
+func TestSpoolLimits(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := &flakyWriter{down: true}
+	s, err := newSpool(dir, 1, 0, w.Write, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(records(0, 5))
+	if d := s.Depth(); d.Records != 0 || d.Segments != 0 {
+		t.Errorf("spool larger than max size %v", d)
+	}
+	s.Stop()
+
+	// the retention must be longer than a write (fsync) of the segment
+	s, err = newSpool(dir, 0, 500*time.Millisecond, w.Write, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	s.Write(records(0, 5))
+	time.Sleep(600 * time.Millisecond)
+	s.Write(records(5, 10))
+	if d := s.Depth(); d.Records != 5 {
+		t.Errorf("expired records not removed %v", d)
+	}
+}
@@ -0,0 +1,372 @@
+// Package sqlite stores records in a local SQLite database, e.g. on single
+// board computers without InfluxDB.
+//
+// The schema is normalized: each combination of measurement and tags is
+// stored once in the series table and each field value is stored in the
+// samples table with a reference to its series.
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	// registers the pure Go sqlite driver
+	_ "modernc.org/sqlite"
+)
+
+// stats exports the number of written samples, pruned samples and errors as
+// sqlite in /debug/vars.
+var stats = expvar.NewMap("sqlite")
+
+// DefaultPruneInterval is the interval between two prunes of old samples.
+const DefaultPruneInterval = time.Hour
+
+const schema = `
+CREATE TABLE IF NOT EXISTS series (
+	id INTEGER PRIMARY KEY,
+	measurement TEXT NOT NULL,
+	tags TEXT NOT NULL,
+	UNIQUE (measurement, tags)
+);
+CREATE TABLE IF NOT EXISTS samples (
+	series_id INTEGER NOT NULL REFERENCES series (id),
+	time INTEGER NOT NULL,
+	field TEXT NOT NULL,
+	value
+);
+CREATE INDEX IF NOT EXISTS samples_series_time ON samples (series_id, time);
+CREATE INDEX IF NOT EXISTS samples_time ON samples (time);
+`
+
+// Writer stores records in a SQLite database.
+type Writer struct {
+	db *sql.DB
+
+	mu sync.Mutex
+	// series caches the id of each series by seriesKey
+	series map[string]int64
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// open opens the database at path and creates the schema.
+func open(path string) (*sql.DB, error) {
+	if path == "" {
+		return nil, errors.New("missing path")
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite supports only one writer
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema in %s: %s", path, err)
+	}
+	return db, nil
+}
+
+// New opens or creates the database file of conf. Samples older than the
+// retention of conf are pruned in the background.
+func New(conf config.SQLite) (*Writer, error) {
+	var retention, interval time.Duration
+	var err error
+	if conf.Retention != "" {
+		if retention, err = time.ParseDuration(conf.Retention); err != nil {
+			return nil, fmt.Errorf("invalid retention: %s", err)
+		}
+	}
+	interval = DefaultPruneInterval
+	if conf.PruneInterval != "" {
+		if interval, err = time.ParseDuration(conf.PruneInterval); err != nil {
+			return nil, fmt.Errorf("invalid prune_interval: %s", err)
+		}
+		if interval <= 0 {
+			return nil, errors.New("prune_interval must be positive")
+		}
+	}
+
+	db, err := open(conf.Path)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		db:      db,
+		series:  make(map[string]int64),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if retention > 0 {
+		go w.pruneLoop(retention, interval)
+	} else {
+		close(w.stopped)
+	}
+	return w, nil
+}
+
+// Write stores all fields of the records within one transaction. Numbers
+// and booleans are stored as REAL, all other values as TEXT.
+func (w *Writer) Write(recs []mqlux.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		stats.Add("errors", 1)
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO samples (series_id, time, field, value) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		stats.Add("errors", 1)
+		return err
+	}
+	defer stmt.Close()
+
+	// new series ids are only cached after the commit
+	created := make(map[string]int64)
+	n := 0
+	for _, rec := range recs {
+		tags := encodeTags(rec.Tags)
+		id, err := w.seriesID(tx, created, rec.Measurement, tags)
+		if err != nil {
+			tx.Rollback()
+			stats.Add("errors", 1)
+			return err
+		}
+		t := rec.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		ms := t.UnixNano() / int64(time.Millisecond)
+		for name, v := range rec.FieldValues() {
+			value, ok := sampleValue(v)
+			if !ok {
+				continue
+			}
+			if _, err := stmt.Exec(id, ms, name, value); err != nil {
+				tx.Rollback()
+				stats.Add("errors", 1)
+				return err
+			}
+			n++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		stats.Add("errors", 1)
+		return err
+	}
+	for k, id := range created {
+		w.series[k] = id
+	}
+	stats.Add("samples_written", int64(n))
+	return nil
+}
+
+// seriesID returns the id of the series and creates it if it does not exist.
+func (w *Writer) seriesID(tx *sql.Tx, created map[string]int64, measurement, tags string) (int64, error) {
+	key := seriesKey(measurement, tags)
+	if id, ok := w.series[key]; ok {
+		return id, nil
+	}
+	if id, ok := created[key]; ok {
+		return id, nil
+	}
+	if _, err := tx.Exec("INSERT OR IGNORE INTO series (measurement, tags) VALUES (?, ?)", measurement, tags); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := tx.QueryRow("SELECT id FROM series WHERE measurement = ? AND tags = ?", measurement, tags).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	created[key] = id
+	return id, nil
+}
+
+// Prune deletes all samples older than retention and all series without
+// samples.
+func (w *Writer) Prune(retention time.Duration) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	before := time.Now().Add(-retention).UnixNano() / int64(time.Millisecond)
+	res, err := w.db.Exec("DELETE FROM samples WHERE time < ?", before)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		stats.Add("samples_pruned", n)
+		log.Printf("debug: pruned %d samples", n)
+	}
+	if _, err := w.db.Exec("DELETE FROM series WHERE id NOT IN (SELECT DISTINCT series_id FROM samples)"); err != nil {
+		return err
+	}
+	w.series = make(map[string]int64)
+	return nil
+}
+
+func (w *Writer) pruneLoop(retention, interval time.Duration) {
+	defer close(w.stopped)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := w.Prune(retention); err != nil {
+			stats.Add("errors", 1)
+			log.Printf("error: pruning samples: %s", err)
+		}
+		select {
+		case <-t.C:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Stop stops pruning and closes the database.
+func (w *Writer) Stop() {
+	close(w.done)
+	<-w.stopped
+	w.db.Close()
+}
+
+// encodeTags returns the tags as JSON object with sorted keys. Empty tags
+// are skipped.
+func encodeTags(tags map[string]string) string {
+	m := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			m[k] = v
+		}
+	}
+	// encoding/json sorts map keys
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+func seriesKey(measurement, tags string) string {
+	return measurement + "\x00" + tags
+}
+
+// sampleValue converts v for the value column.
+func sampleValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return v, true
+	}
+	if f, ok := mqlux.Float(v); ok {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, false
+		}
+		return f, true
+	}
+	return fmt.Sprint(v), true
+}
+
+// Query selects samples with Select.
+type Query struct {
+	Measurement string
+	// Field is optional, all fields are returned if empty.
+	Field string
+	// Tags filters series by tag values.
+	Tags map[string]string
+	// Since and Until limit the time range (optional).
+	Since, Until time.Time
+	// Limit is the maximum number of samples (optional).
+	Limit int
+}
+
+// Sample is a single stored field value.
+type Sample struct {
+	Time        time.Time
+	Measurement string
+	Tags        map[string]string
+	Field       string
+	Value       interface{}
+}
+
+// Select returns all samples of the database at path that match q,
+// ordered by time.
+func Select(path string, q Query) ([]Sample, error) {
+	// do not create a new database for a wrong path
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	where := "s.measurement = ?"
+	args := []interface{}{q.Measurement}
+	if q.Field != "" {
+		where += " AND p.field = ?"
+		args = append(args, q.Field)
+	}
+	keys := make([]string, 0, len(q.Tags))
+	for k := range q.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		path, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		where += " AND json_extract(s.tags, ?) = ?"
+		args = append(args, "$."+string(path), q.Tags[k])
+	}
+	if !q.Since.IsZero() {
+		where += " AND p.time >= ?"
+		args = append(args, q.Since.UnixNano()/int64(time.Millisecond))
+	}
+	if !q.Until.IsZero() {
+		where += " AND p.time < ?"
+		args = append(args, q.Until.UnixNano()/int64(time.Millisecond))
+	}
+	query := "SELECT p.time, s.measurement, s.tags, p.field, p.value FROM samples p JOIN series s ON s.id = p.series_id WHERE " +
+		where + " ORDER BY p.time, s.id, p.field"
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var samples []Sample
+	for rows.Next() {
+		var s Sample
+		var ms int64
+		var tags string
+		if err := rows.Scan(&ms, &s.Measurement, &tags, &s.Field, &s.Value); err != nil {
+			return nil, err
+		}
+		s.Time = time.Unix(0, ms*int64(time.Millisecond))
+		if err := json.Unmarshal([]byte(tags), &s.Tags); err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
@@ -0,0 +1,146 @@
+package sqlite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqlux-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mqlux.db")
+
+	w, err := New(config.SQLite{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	now := time.Now().Truncate(time.Millisecond)
+	old := now.Add(-48 * time.Hour)
+	err = w.Write([]mqlux.Record{
+		{Measurement: "temperature", Tags: map[string]string{"room": "kitchen"}, Value: 19.0, Time: old},
+		{Measurement: "temperature", Tags: map[string]string{"room": "kitchen"}, Value: 21.5, Time: now},
+		{Measurement: "temperature", Tags: map[string]string{"room": "office", "empty": ""}, Value: 23.0, Time: now},
+		{
+			Measurement: "climate",
+			Tags:        map[string]string{"room": "kitchen"},
+			Fields:      map[string]interface{}{"humidity": 40, "open": true, "status": "ok", "none": nil},
+			Time:        now,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same series again
+	if err := w.Write([]mqlux.Record{{Measurement: "temperature", Tags: map[string]string{"room": "office"}, Value: 23.5, Time: now.Add(time.Second)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	kitchen := map[string]string{"room": "kitchen"}
+	office := map[string]string{"room": "office"}
+	for _, test := range []struct {
+		Query Query
+		Want  []Sample
+	}{
+		{
+			Query: Query{Measurement: "temperature", Tags: kitchen},
+			Want: []Sample{
+				{old, "temperature", kitchen, "value", 19.0},
+				{now, "temperature", kitchen, "value", 21.5},
+			},
+		},
+		{
+			Query: Query{Measurement: "temperature", Since: now.Add(-time.Hour)},
+			Want: []Sample{
+				{now, "temperature", kitchen, "value", 21.5},
+				{now, "temperature", office, "value", 23.0},
+				{now.Add(time.Second), "temperature", office, "value", 23.5},
+			},
+		},
+		{
+			Query: Query{Measurement: "temperature", Since: now.Add(-time.Hour), Limit: 1},
+			Want:  []Sample{{now, "temperature", kitchen, "value", 21.5}},
+		},
+		{
+			Query: Query{Measurement: "climate"},
+			Want: []Sample{
+				{now, "climate", kitchen, "humidity", 40.0},
+				{now, "climate", kitchen, "open", 1.0},
+				{now, "climate", kitchen, "status", "ok"},
+			},
+		},
+		{
+			Query: Query{Measurement: "climate", Field: "status"},
+			Want:  []Sample{{now, "climate", kitchen, "status", "ok"}},
+		},
+		{
+			Query: Query{Measurement: "temperature", Tags: map[string]string{"room": "garage"}},
+		},
+	} {
+		samples, err := Select(path, test.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != len(test.Want) {
+			t.Errorf("unexpected samples for %v\n%v\n!=\n%v", test.Query, samples, test.Want)
+			continue
+		}
+		for i := range samples {
+			if !samples[i].Time.Equal(test.Want[i].Time) {
+				t.Errorf("unexpected time %s != %s", samples[i].Time, test.Want[i].Time)
+			}
+			samples[i].Time = test.Want[i].Time
+		}
+		if !reflect.DeepEqual(samples, test.Want) {
+			t.Errorf("unexpected samples for %v\n%v\n!=\n%v", test.Query, samples, test.Want)
+		}
+	}
+
+	if err := w.Prune(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	samples, err := Select(path, Query{Measurement: "temperature", Tags: kitchen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].Value != 21.5 {
+		t.Errorf("unexpected samples after prune %v", samples)
+	}
+	// series cache is reset after prune
+	if err := w.Write([]mqlux.Record{{Measurement: "temperature", Tags: kitchen, Value: 22.0, Time: now.Add(time.Second)}}); err != nil {
+		t.Fatal(err)
+	}
+	var series int
+	if err := w.db.QueryRow("SELECT count(*) FROM series").Scan(&series); err != nil {
+		t.Fatal(err)
+	}
+	if series != 3 {
+		t.Errorf("unexpected number of series %d", series)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, conf := range []config.SQLite{
+		{},
+		{Path: "mqlux.db", Retention: "30 days"},
+		{Path: "mqlux.db", Retention: "720h", PruneInterval: "0s"},
+	} {
+		if _, err := New(conf); err == nil {
+			t.Errorf("expected error for %v", conf)
+		}
+	}
+	if _, err := Select("/nonexistent/mqlux.db", Query{Measurement: "temperature"}); err == nil {
+		t.Error("expected error for missing database")
+	}
+}
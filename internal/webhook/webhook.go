@@ -0,0 +1,225 @@
+// Package webhook sends records to arbitrary HTTP endpoints (e.g. Home
+// Assistant webhooks, Node-RED or internal APIs). The request body is created
+// with a text/template.
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+	"github.com/ktt-ol/mqlux/internal/retry"
+)
+
+// stats exports the number of sent requests and errors as webhook in
+// /debug/vars.
+var stats = expvar.NewMap("webhook")
+
+// DefaultTemplate encodes the records (or the record in record mode) as
+// JSON.
+const DefaultTemplate = "{{json .}}"
+
+// Record is passed to the template. In batch mode, the template is executed
+// with a []Record.
+type Record struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Value       interface{}            `json:"value,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+	Time        time.Time              `json:"time"`
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Writer sends records to an HTTP endpoint.
+type Writer struct {
+	url         string
+	method      string
+	headers     map[string]string
+	contentType string
+	perRecord   bool
+	tmpl        *template.Template
+	httpClient  *http.Client
+	backoff     retry.Backoff
+}
+
+// New creates a new Writer.
+func New(conf config.Webhook) (*Writer, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("webhook url requires http or https scheme")
+	}
+
+	text := conf.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New("webhook").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %s", err)
+	}
+
+	w := &Writer{
+		url:         u.String(),
+		method:      strings.ToUpper(conf.Method),
+		headers:     conf.Headers,
+		contentType: conf.ContentType,
+		tmpl:        tmpl,
+	}
+	if w.method == "" {
+		w.method = "POST"
+	}
+	if w.contentType == "" {
+		w.contentType = "application/json"
+	}
+	switch conf.Mode {
+	case "", "batch":
+	case "record":
+		w.perRecord = true
+	default:
+		return nil, fmt.Errorf("invalid mode %s, expected batch or record", conf.Mode)
+	}
+
+	timeout := 30 * time.Second
+	if conf.Timeout != "" {
+		if timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %s", err)
+		}
+	}
+	tlsConf, err := tlsConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	w.httpClient = &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConf},
+	}
+
+	w.backoff = retry.DefaultBackoff(retry.Attempts(conf.Retries))
+	return w, nil
+}
+
+func tlsConfig(conf config.Webhook) (*tls.Config, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: conf.TLSServerInsecure}
+	if conf.TLSServerCert != "" {
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM([]byte(conf.TLSServerCert)) {
+			return nil, errors.New("unable to add tls_server_cert to CertPool")
+		}
+	}
+	if conf.TLSClientCert != "" || conf.TLSClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(conf.TLSClientCert), []byte(conf.TLSClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls_client_cert or tls_client_key: %s", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// Write sends all records with a single request, or with one request for
+// each record in record mode. Transient errors are retried. In record mode,
+// Write stops at the first failed request. The records before were already
+// sent, delivery is at-least-once if the caller writes the records again.
+func (w *Writer) Write(recs []mqlux.Record) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	if !w.perRecord {
+		data := make([]Record, len(recs))
+		for i, rec := range recs {
+			data[i] = templateRecord(rec)
+		}
+		return w.send(data, len(recs))
+	}
+	for i, rec := range recs {
+		if err := w.send(templateRecord(rec), 1); err != nil {
+			if i > 0 {
+				return fmt.Errorf("sent %d of %d records: %s", i, len(recs), err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// send executes the template with data and sends the body.
+func (w *Writer) send(data interface{}, records int) error {
+	var body bytes.Buffer
+	if err := w.tmpl.Execute(&body, data); err != nil {
+		stats.Add("errors", 1)
+		return fmt.Errorf("executing template: %s", err)
+	}
+	err := w.backoff.Do(func() error {
+		return w.do(body.Bytes())
+	}, func(err error, delay time.Duration) {
+		stats.Add("retries", 1)
+		log.Printf("warning: webhook request with %d records, retrying in %s: %s", records, delay, err)
+	})
+	if err != nil {
+		stats.Add("errors", 1)
+		return err
+	}
+	stats.Add("requests", 1)
+	stats.Add("records_written", int64(records))
+	return nil
+}
+
+func (w *Writer) do(body []byte) error {
+	req, err := http.NewRequest(w.method, w.url, bytes.NewReader(body))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", w.contentType)
+	req.Header.Set("User-Agent", "mqlux")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return retry.StatusError(resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func templateRecord(rec mqlux.Record) Record {
+	t := rec.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return Record{
+		Measurement: rec.Measurement,
+		Tags:        rec.Tags,
+		Value:       rec.Value,
+		Fields:      rec.Fields,
+		Time:        t,
+	}
+}
@@ -0,0 +1,163 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ktt-ol/mqlux/internal/config"
+	"github.com/ktt-ol/mqlux/internal/mqlux"
+)
+
+var records = []mqlux.Record{
+	{Measurement: "people", Tags: map[string]string{"room": "space"}, Value: 42.0, Time: time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)},
+	{Measurement: "status", Fields: map[string]interface{}{"open": true}, Time: time.Date(2018, 2, 1, 12, 0, 1, 0, time.UTC)},
+}
+
+type request struct {
+	Method      string
+	ContentType string
+	Token       string
+	Body        string
+}
+
+func TestWebhook(t *testing.T) {
+	for _, test := range []struct {
+		Conf config.Webhook
+		Want []request
+	}{
+		{
+			Conf: config.Webhook{},
+			Want: []request{{
+				"POST", "application/json", "",
+				`[{"measurement":"people","tags":{"room":"space"},"value":42,"time":"2018-02-01T12:00:00Z"},` +
+					`{"measurement":"status","fields":{"open":true},"time":"2018-02-01T12:00:01Z"}]`,
+			}},
+		},
+		{
+			Conf: config.Webhook{
+				Method:      "put",
+				Mode:        "record",
+				ContentType: "text/plain",
+				Headers:     map[string]string{"Authorization": "Bearer secret"},
+				Template:    `{{.Measurement}}{{range $k, $v := .Tags}},{{$k}}={{$v}}{{end}} {{with .Value}}{{.}}{{else}}{{json .Fields}}{{end}} {{.Time.Unix}}`,
+			},
+			Want: []request{
+				{"PUT", "text/plain", "Bearer secret", "people,room=space 42 1517486400"},
+				{"PUT", "text/plain", "Bearer secret", `status {"open":true} 1517486401`},
+			},
+		},
+	} {
+		var requests []request
+		fail := 1
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fail > 0 {
+				fail--
+				http.Error(w, "unavailable", http.StatusBadGateway)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			requests = append(requests, request{r.Method, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), string(body)})
+		}))
+
+		test.Conf.URL = srv.URL
+		w, err := New(test.Conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.backoff.Min = time.Millisecond
+		if err := w.Write(records); err != nil {
+			t.Error(err)
+		}
+		srv.Close()
+		if !reflect.DeepEqual(requests, test.Want) {
+			t.Errorf("unexpected requests\n%v\n!=\n%v", requests, test.Want)
+		}
+	}
+}
+
+func TestWebhookErrors(t *testing.T) {
+	for _, conf := range []config.Webhook{
+		{},
+		{URL: "localhost:8123"},
+		{URL: "http://localhost:8123", Template: "{{.Measurement"},
+		{URL: "http://localhost:8123", Mode: "stream"},
+		{URL: "http://localhost:8123", Timeout: "10"},
+		{URL: "https://localhost:8123", TLSServerCert: "invalid"},
+		{URL: "https://localhost:8123", TLSClientCert: "invalid"},
+	} {
+		if _, err := New(conf); err == nil {
+			t.Errorf("expected error for %v", conf)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	w, err := New(config.Webhook{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(records); err == nil {
+		t.Error("expected error for bad request")
+	}
+
+	w, err = New(config.Webhook{URL: srv.URL, Template: "{{.Missing}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(records); err == nil {
+		t.Error("expected template error")
+	}
+}
+
+func TestWebhookRecordMode(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	// retries are disabled, the second record fails and the third record is
+	// not sent
+	w, err := New(config.Webhook{URL: srv.URL, Mode: "record", Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := append(append([]mqlux.Record(nil), records...), mqlux.Record{Measurement: "people", Value: 1.0})
+	if err := w.Write(recs); err == nil {
+		t.Error("expected error for failed request")
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestWebhookTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	w, err := New(config.Webhook{URL: srv.URL, Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backoff.Min = time.Millisecond
+	if err := w.Write(records); err == nil {
+		t.Error("expected error for unknown certificate")
+	}
+
+	w, err = New(config.Webhook{URL: srv.URL, TLSServerInsecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(records); err != nil {
+		t.Error(err)
+	}
+}